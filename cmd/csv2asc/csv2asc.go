@@ -6,11 +6,9 @@ package main
 import (
 	"bufio"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/realh/repmap/pkg/repton2"
@@ -19,10 +17,12 @@ import (
 func main() {
 	var fd *os.File
 	var err error
+	name := "stdin"
 	if len(os.Args) == 2 {
-		fd, err = os.Open(os.Args[1])
+		name = os.Args[1]
+		fd, err = os.Open(name)
 		if err != nil {
-			log.Fatalf("Error opening '%s': %v", os.Args[1], err)
+			log.Fatalf("Error opening '%s': %v", name, err)
 		}
 	} else if len(os.Args) == 1 {
 		fd = os.Stdin
@@ -31,52 +31,41 @@ func main() {
 	var line string
 	line, err = rdr.ReadString('\n')
 	if err != nil {
-		log.Fatalf("Failed to read first line of '%s': %v", os.Args[1], err)
+		log.Fatalf("Failed to read first line of '%s': %v", name, err)
 	}
 	// In case of DOS line endings
-	line = strings.TrimSpace(line)
-	fmt.Println(line)
+	theme, err := repton2.ParseTheme(strings.TrimSpace(line))
+	if err != nil {
+		log.Fatalf("%s: line 1: %v", name, err)
+	}
+	m := &repton2.Map{Theme: theme}
+	lineNum := 1
 	for err == nil {
 		line, err = rdr.ReadString('\n')
+		lineNum++
 		line = strings.TrimSpace(line)
 		if len(line) == 0 {
 			break
 		}
 		codes := strings.Split(line, ",")
-		asc := make([]byte, len(codes))
-		for i, s := range codes {
-			var t byte
-			if s == "unk" {
-				t = repton2.T_PUZZLE
-			} else {
-				v, err := strconv.ParseInt(s, 10, 8)
-				if err != nil {
-					log.Fatalf("Can't parse '%s' as number", s)
-				}
-				t = byte(v)
-				// Gerald's format has some different numbers
-				if t == 31 {
-					t = repton2.T_SKULL_RED
-				} else if t == 33 {
-					t = repton2.T_EGG
-				} else if t == 34 {
-					t = repton2.T_KEY
-				} else if t == 30 {
-					t = repton2.T_SAVE
-				}
-			}
-			if t == 0 {
-				t = '.'
-			} else if t <= 9 {
-				t += '0'
-			} else {
-				t += 'A' - 10
+		if m.Height != 0 && len(codes) != m.Width {
+			log.Fatalf("%s: line %d: row has %d tiles, expected %d",
+				name, lineNum, len(codes), m.Width)
+		}
+		for _, s := range codes {
+			t, err := repton2.ParseRMDString(s)
+			if err != nil {
+				log.Fatalf("%s: line %d: %v", name, lineNum, err)
 			}
-			asc[i] = t
+			m.Tiles = append(m.Tiles, t)
 		}
-		fmt.Println(string(asc))
+		m.Width = len(codes)
+		m.Height++
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Fatalf("Error reading '%s': %v", name, err)
 	}
-	if !errors.Is(err, io.EOF) {
-		log.Fatalf("Error reading '%s': %v", os.Args[1], err)
+	if err := m.WriteASCII(os.Stdout); err != nil {
+		log.Fatalf("Error writing output: %v", err)
 	}
 }
@@ -4,244 +4,1469 @@
 // scenario folders. $2 contains the reference tile hashes in JSON format. $3
 // is the output folder; it will be filled with folders/files mirroring the
 // structure below input but with each .png replaced by a .txt. If the input
-// is a single file, the output folder must exist, otherwise folders will be
-// created if necessary.
+// is a single file, the output folder must exist, or $3 can instead be the
+// name of the text file; otherwise folders will be created if necessary.
+//
+// Which files count as level screenshots, how deep into subfolders to look,
+// and how the text files are named can be changed with -pattern, -depth,
+// -include, -exclude and -output-template; see LevelFinder.
+//
+// Tiles are classified by edshot.ClassifyMap with an edshot.ChainClassifier;
+// other programs can use ClassifyMap or edshot.ConvertMap with their own
+// edshot.TileClassifier. Tiles whose hashes aren't found in the reference set
+// are unrecognised. If -unknown-as-puzzle=false they are output as '?',
+// otherwise (the default) they are assumed to be puzzle pieces. If a folder of
+// reference sprites is given with -sprites (see sprites.LoadDir; refhash can
+// make one), such tiles are first compared against the sprites for the map's
+// theme with edshot.FuzzyClassifier, so that screenshots which have been
+// through lossy compression etc can still be converted. Similarly -samples
+// gives a folder of tiles saved by -learn and labelled, for
+// edshot.NearestClassifier. -threshold sets the maximum distance for these
+// inexact matches.
+//
+// With -report a JSON file is written alongside each text file, listing how
+// each tile was classified and with what confidence. With -debug an annotated
+// copy of each screenshot (eg 01.debug.png) is saved alongside each text
+// file, even if the screenshot couldn't be analysed. With -learn folder, each
+// distinct unrecognised tile is saved in that folder along with a list of
+// where they were found and a template labels file for mergehashes.
+//
+// Screenshots are processed by RunPipeline, with -workers goroutines per stage
+// and up to about -max-memory MB of decoded screenshots at once. Each map's
+// messages are logged in input order, and output files are written
+// atomically, so an interrupt (SIGINT) stops img2map without leaving any
+// half-written.
+//
+// A Cache in the output folder records the content hash of each converted
+// screenshot, along with the reference hashes and options used and whether a
+// report and debug image were saved, so that screenshots which haven't
+// changed since the last run, and already have the requested outputs, are
+// skipped. -force converts everything anyway. Outputs whose screenshot has
+// gone are reported.
+//
+// With -summary, a newline-delimited JSON summary of the run is written (see
+// WriteRunSummary), including totals for each scenario to compare with the
+// default 104 puzzle pieces. img2map exits with status 1 if any screenshot
+// couldn't be converted.
+//
+// With -watch, img2map keeps polling the input every -interval (see Watcher)
+// and converts new or modified screenshots as they appear, logging a one-line
+// summary of each, until interrupted.
+//
+// The colour theme is detected by edshot.DetectTheme, so that a level isn't
+// lost if the pixel normally used to detect it is obscured.
 //
 // The first line of the text file contains the colour theme eg "Blue". Each
 // subsequent line is a string of characters representing a map row. '.' means
 // a blank space, the next 9 tile types (in the order of the T_ constants) are
-// represented by '0'-'9' and the rest by 'A'-'Z'.
+// represented by '1'-'9' and the rest by 'A'-'X'. See repton2.Map.
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
+	"image/png"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-	"unicode"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/realh/repmap/pkg/edshot"
 	"github.com/realh/repmap/pkg/repton"
 	"github.com/realh/repmap/pkg/repton2"
+	"github.com/realh/repmap/pkg/sprites"
 )
 
-// GetMapHashes returns hashes of the tiles in the map region.
-func GetMapHashes(img image.Image, mapBounds image.Rectangle) []uint32 {
-	w := (mapBounds.Max.X - mapBounds.Min.X) / edshot.MAP_TILE_WIDTH
-	h := (mapBounds.Max.Y - mapBounds.Min.Y) / edshot.MAP_TILE_HEIGHT
-	positions := make([]image.Point, w*h)
-	ch := make(chan bool, w*h)
-	i := 0
-	for y := 0; y < h; y++ {
-		for x := 0; x < w; x++ {
-			go func(x, y, i int) {
-				positions[i] = image.Point{x, y}
-				ch <- true
-			}(x, y, i)
-			i++
-		}
-	}
-	for range positions {
-		<-ch
-	}
-	return edshot.HashMapTiles(img, mapBounds, positions)
-}
-
-// ProcessMap loads the map and works out what each tile represents using
-// refTiles. It saves a text file representation of the map and returns the
-// number of puzzle pieces.
-func ProcessMap(inFilename, outFilename string, refTiles map[string][]uint32,
-) int {
-	img, mapBounds, selBounds, err := edshot.LoadMap(inFilename)
-	if err != nil {
-		log.Println(err)
-		return 0
-	}
-	// What colour is this map?
-	cTheme := edshot.GetMapColourTheme(img, selBounds)
-	if cTheme == -1 || cTheme == repton.KC_BLACK {
-		log.Printf("Failed to detect colour theme of '%s'", inFilename)
-		return 0
-	}
-	clrName := repton.ColourNames[cTheme]
-	w := (mapBounds.Max.X - mapBounds.Min.X) / edshot.MAP_TILE_WIDTH
-	h := (mapBounds.Max.Y - mapBounds.Min.Y) / edshot.MAP_TILE_HEIGHT
-	log.Printf("Map '%s' is %s and %d x %d", inFilename, clrName, w, h)
-	// Make the hash array into a map
-	refHashes := make(map[uint32]int)
-	for i, h := range refTiles[clrName] {
-		refHashes[h] = i
-	}
-	hashedTiles := GetMapHashes(img, mapBounds)
-	n := len(hashedTiles)
-	tValues := make([]byte, n)
-	ch := make(chan bool, n)
-	for i, h := range hashedTiles {
-		go func(i int, h uint32) {
-			t, ok := refHashes[h]
-			if !ok {
-				t = repton2.T_PUZZLE
-			}
-			var c byte
-			if t == 0 {
-				c = '.'
-			} else if t < 10 {
-				c = '0' + byte(t)
-			} else {
-				c = 'A' + byte(t-10)
-			}
-			tValues[i] = c
-			ch <- ok
-		}(i, h)
+// Config holds the settings which apply to every map.
+type Config struct {
+	RefTiles        edshot.RefHashes
+	Classifier      edshot.TileClassifier
+	UnknownAsPuzzle bool
+	WriteReports    bool
+	Workers         int
+	Budget          *MemoryBudget
+	Debug           bool
+	Learner         *Learner
+	Cache           *Cache
+	Force           bool   // Ignore Cache
+	RefsVersion     string // Identifies RefTiles in the cache
+	Options         string // Settings which affect the output, for the cache
+	Summarise       bool   // Log each job's Summary instead of its messages
+}
+
+// MAX_LEARN_SAMPLES is the maximum number of locations recorded for each tile
+// in learn mode.
+const MAX_LEARN_SAMPLES = 10
+
+// LearnSample is a location where an unrecognised tile was found.
+type LearnSample struct {
+	Input string `json:"input"`
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+}
+
+// LearnedTile is a distinct unrecognised tile found in learn mode.
+type LearnedTile struct {
+	Theme   string        `json:"theme"`
+	Hash    uint32        `json:"hash"`
+	Count   int           `json:"count"`
+	Samples []LearnSample `json:"samples"`
+	img     image.Image
+}
+
+// Learner collects unrecognised tiles from any number of maps in learn mode.
+// It's safe to use from multiple goroutines.
+type Learner struct {
+	lock  sync.Mutex
+	tiles map[string]*LearnedTile
+}
+
+// NewLearner creates an empty Learner.
+func NewLearner() *Learner {
+	return &Learner{tiles: make(map[string]*LearnedTile)}
+}
+
+// Add records an unrecognised tile with the given hash at (x, y) in a map with
+// the given theme. The tile's image is extracted from img the first time
+// each hash is seen.
+func (l *Learner) Add(theme string, hash uint32, img image.Image,
+	grid edshot.Grid, input string, x, y int,
+) {
+	key := fmt.Sprintf("%s/%d", theme, hash)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lt := l.tiles[key]
+	if lt == nil {
+		lt = &LearnedTile{Theme: theme, Hash: hash,
+			img: grid.ExtractTile(img, x, y)}
+		l.tiles[key] = lt
 	}
-	// await and count puzzle pieces
-	nPuzzles := 0
-	for range tValues {
-		if !<-ch {
-			nPuzzles++
+	lt.Count++
+	if len(lt.Samples) < MAX_LEARN_SAMPLES {
+		lt.Samples = append(lt.Samples, LearnSample{input, x, y})
+	}
+}
+
+// Save writes each tile's image to dir/Theme/hash.png, and a list of the
+// tiles, most frequent first, to dir/learned.json. It also writes a template
+// for mergehashes' labels file to dir/labels.csv, unless it already exists.
+func (l *Learner) Save(dir string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	tiles := make([]*LearnedTile, 0, len(l.tiles))
+	for _, lt := range l.tiles {
+		tiles = append(tiles, lt)
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		a, b := tiles[i], tiles[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Theme != b.Theme {
+			return a.Theme < b.Theme
+		}
+		return a.Hash < b.Hash
+	})
+	var labels strings.Builder
+	labels.WriteString("# Theme,hash,tile name\n")
+	for _, lt := range tiles {
+		d := filepath.Join(dir, lt.Theme)
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+		err := repton.SavePNG(lt.img,
+			filepath.Join(d, fmt.Sprintf("%d.png", lt.Hash)))
+		if err != nil {
+			return err
 		}
+		fmt.Fprintf(&labels, "%s,%d,\n", lt.Theme, lt.Hash)
+	}
+	data, err := json.MarshalIndent(tiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "learned.json"),
+		append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	labelsFile := filepath.Join(dir, "labels.csv")
+	if _, err := os.Stat(labelsFile); err == nil {
+		log.Printf("Not overwriting existing '%s'", labelsFile)
+		return nil
+	}
+	return os.WriteFile(labelsFile, []byte(labels.String()), 0644)
+}
+
+// TileReport describes how one tile was classified.
+type TileReport struct {
+	X          int     `json:"x"`
+	Y          int     `json:"y"`
+	Tile       string  `json:"tile"`
+	Method     string  `json:"method"`
+	Confidence float64 `json:"confidence"`
+}
+
+// MapReport is the format of the JSON report written alongside each map.
+type MapReport struct {
+	Input       string       `json:"input"`
+	Theme       string       `json:"theme"`
+	ThemeMethod string       `json:"theme_method"`
+	ThemeMargin float64      `json:"theme_margin"`
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	Tiles       []TileReport `json:"tiles"`
+}
+
+// WriteMapReport saves a MapReport for a map's classifications as JSON.
+func WriteMapReport(filename, inFilename string, m *repton2.Map,
+	theme edshot.ThemeDetection, classes []edshot.Classification,
+) error {
+	report := MapReport{
+		Input:       inFilename,
+		Theme:       m.Theme,
+		ThemeMethod: theme.Method,
+		ThemeMargin: theme.Margin,
+		Width:       m.Width,
+		Height:      m.Height,
+		Tiles:       make([]TileReport, len(classes)),
+	}
+	for i, c := range classes {
+		report.Tiles[i] = TileReport{i % m.Width, i / m.Width,
+			repton2.TileName(c.Tile), c.Method, c.Confidence}
+	}
+	data, err := json.MarshalIndent(&report, "", "  ")
+	if err == nil {
+		err = repton.WriteFileAtomic(filename, func(w io.Writer) error {
+			_, err := w.Write(append(data, '\n'))
+			return err
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write report '%s': %v", filename, err)
 	}
-	fd, err := os.Create(outFilename)
+	return nil
+}
+
+// SaveDebugImage saves a copy of img annotated with trace.
+func SaveDebugImage(filename string, img image.Image, trace *edshot.Trace,
+) error {
+	err := repton.WriteFileAtomic(filename, func(w io.Writer) error {
+		return png.Encode(w, trace.Draw(img))
+	})
 	if err != nil {
-		log.Printf("Failed to create output file '%s': %v", outFilename, err)
-		return nPuzzles
+		return fmt.Errorf("Failed to save debug image '%s': %v", filename, err)
 	}
-	defer fd.Close()
-	fmt.Fprintf(fd, "%s\n", clrName)
-	for row := 0; row < n; row += w {
-		fd.Write(tValues[row : row+w])
-		fmt.Fprintln(fd, "")
+	return nil
+}
+
+// MemoryBudget limits the total size of the decoded screenshots in img2map's
+// pipeline. Decoding waits until enough earlier screenshots have been
+// finished with, so that converting a large folder doesn't use an unbounded
+// amount of memory.
+type MemoryBudget struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	free  int64
+	limit int64
+}
+
+// NewMemoryBudget creates a MemoryBudget of limit bytes.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	b := &MemoryBudget{free: limit, limit: limit}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+// Acquire waits until n bytes are free and reserves them. If n is more than
+// the whole budget, it waits for all of it instead. The result is the amount
+// reserved, to be passed to Release.
+func (b *MemoryBudget) Acquire(n int64) int64 {
+	n = min(n, b.limit)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.free < n {
+		b.cond.Wait()
 	}
-	log.Printf("%s contains %d puzzle pieces", inFilename, nPuzzles)
-	return nPuzzles
+	b.free -= n
+	return n
+}
+
+// Release returns n bytes reserved by Acquire to the budget.
+func (b *MemoryBudget) Release(n int64) {
+	b.lock.Lock()
+	b.free += n
+	b.lock.Unlock()
+	b.cond.Broadcast()
+}
+
+// CACHE_FILE is the name of the manifest img2map keeps in the output folder
+// so that screenshots which haven't changed since they were last converted
+// can be skipped.
+const CACHE_FILE = ".img2map-cache.json"
+
+// CacheEntry records the successful conversion of one screenshot. Refs
+// identifies the reference hashes used and Options the other settings which
+// affect the output; if either differs the screenshot is converted again.
+// Report and Debug record whether the report and debug image were saved, so
+// that the screenshot is also converted again if they're wanted now but
+// weren't then.
+type CacheEntry struct {
+	Input     string `json:"input"`
+	InputHash string `json:"input_hash"`
+	Refs      string `json:"refs"`
+	Options   string `json:"options"`
+	Theme     string `json:"theme"`
+	Puzzles   int    `json:"puzzles"`
+	Unknown   int    `json:"unknown"`
+	Report    bool   `json:"report,omitempty"`
+	Debug     bool   `json:"debug,omitempty"`
+}
+
+// reportFilename and debugFilename return the names of the report and debug
+// image saved alongside the text file out.
+func reportFilename(out string) string {
+	return strings.TrimSuffix(out, ".txt") + ".json"
+}
+
+func debugFilename(out string) string {
+	return strings.TrimSuffix(out, ".txt") + ".debug.png"
 }
 
-// Returns true if filename matches "xx.png" where xx are digits, and it is a
-// file
-func isLevelPng(filename string) bool {
-	_, leafname := filepath.Split(filename)
-	if len(leafname) != 6 || !unicode.IsDigit(rune(leafname[0])) ||
-		!unicode.IsDigit(rune(leafname[1])) {
+// hasOutputs returns true if the text file out exists, along with the report
+// and debug image if cfg asks for them, and e shows they were all saved by
+// the same conversion.
+func (e *CacheEntry) hasOutputs(out string, cfg *Config) bool {
+	if (cfg.WriteReports && !e.Report) || (cfg.Debug && !e.Debug) {
 		return false
 	}
-	if strings.HasSuffix(leafname, ".png") {
-		stat, err := os.Stat(filename)
-		if err != nil {
-			log.Printf("Error reading '%s': %v", filename, err)
+	files := []string{out}
+	if cfg.WriteReports {
+		files = append(files, reportFilename(out))
+	}
+	if cfg.Debug {
+		files = append(files, debugFilename(out))
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
 			return false
 		}
-		return !stat.IsDir()
 	}
-	return false
+	return true
+}
+
+// Cache is the manifest stored in CACHE_FILE. Entries are keyed by the path of
+// the output file relative to the cache's folder. It's safe to use from
+// multiple goroutines.
+type Cache struct {
+	Entries  map[string]*CacheEntry `json:"entries"`
+	filename string
+	lock     sync.Mutex
+}
+
+// LoadCache loads the cache manifest in dir. If it doesn't exist, or can't be
+// read, the result is an empty cache which will be saved there.
+func LoadCache(dir string) *Cache {
+	c := &Cache{filename: filepath.Join(dir, CACHE_FILE)}
+	data, err := os.ReadFile(c.filename)
+	if err == nil {
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Ignoring cache '%s': %v", c.filename, err)
+	}
+	if err != nil || c.Entries == nil {
+		c.Entries = make(map[string]*CacheEntry)
+	}
+	return c
+}
+
+func (c *Cache) key(outFilename string) string {
+	rel, err := filepath.Rel(filepath.Dir(c.filename), outFilename)
+	if err != nil {
+		rel = outFilename
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Lookup returns the entry for an output file, or nil.
+func (c *Cache) Lookup(outFilename string) *CacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Entries[c.key(outFilename)]
 }
 
-// ProcessRecursive processes the PNGs where inputRoot meets the conditions in
-// the comment at the top of this file. ch should be long enough to run a
-// decent number of goroutines in parallel. The result is the number of values
-// you should read from ch to await all the goroutines this starts. Each value
-// sent down ch is the number of puzzle pieces found in a level
-func ProcessRecursive(inputRoot, outputRoot, child string,
-	refTiles map[string][]uint32, ch chan int,
-) int {
-	var inPath, outPath string
-	if child != "" {
-		inPath = filepath.Join(inputRoot, child)
-		outPath = filepath.Join(outputRoot, child)
+// Update sets the entry for an output file, or removes it if entry is nil. c
+// may be nil, in which case it does nothing.
+func (c *Cache) Update(outFilename string, entry *CacheEntry) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if entry != nil {
+		c.Entries[c.key(outFilename)] = entry
 	} else {
-		inPath = inputRoot
-		outPath = outputRoot
+		delete(c.Entries, c.key(outFilename))
 	}
-	if isLevelPng(inPath) {
-		go func() {
-			outPath = outPath[:len(outPath)-3] + "txt"
-			ch <- ProcessMap(inPath, outPath, refTiles)
-		}()
-		return 1
+}
+
+// Orphans returns the output files whose input no longer exists, sorted.
+// Entries whose output has gone too are forgotten.
+func (c *Cache) Orphans() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var orphans []string
+	for key, entry := range c.Entries {
+		if _, err := os.Stat(entry.Input); err == nil {
+			continue
+		}
+		out := filepath.Join(filepath.Dir(c.filename), filepath.FromSlash(key))
+		if _, err := os.Stat(out); err != nil {
+			delete(c.Entries, key)
+		} else {
+			orphans = append(orphans, out)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// Save writes the cache to its file.
+func (c *Cache) Save() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The folder doesn't exist yet if no screenshots were found
+	if err := os.MkdirAll(filepath.Dir(c.filename), 0755); err != nil {
+		return err
+	}
+	return repton.WriteFileAtomic(c.filename, func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// FileFingerprint returns a SHA-256 hash of data as a hex string.
+func FileFingerprint(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Job is a level screenshot being converted by RunPipeline. Each stage of the
+// pipeline fills in more of its fields. Index is its position in the input
+// order. NPuzzles counts unrecognised tiles as puzzle pieces, even if they're
+// output as '?' because UnknownAsPuzzle isn't set, so that it can always be
+// compared with the size of the puzzle.
+type Job struct {
+	Index     int
+	In, Out   string
+	NPuzzles  int
+	NUnknown  int
+	Failed    bool
+	Skipped   bool // Unchanged since the conversion recorded in the cache
+	Converted bool // The output was written
+	Theme     string
+
+	err       error
+	inputHash string
+	img       image.Image
+	reserved  int64
+	trace     *edshot.Trace
+	grid      edshot.Grid
+	selBounds image.Rectangle
+	scale     edshot.Scale
+	theme     edshot.ThemeDetection
+	hashes    []uint32
+	classes   []edshot.Classification
+	m         *repton2.Map
+	logs      []string
+}
+
+// logf adds a message to the job's log, which is output by Report so that
+// the messages from each job appear together and in input order.
+func (j *Job) logf(format string, args ...any) {
+	j.logs = append(j.logs, fmt.Sprintf(format, args...))
+}
+
+// fail logs err and marks the job as failed so that later stages skip it.
+func (j *Job) fail(err error) {
+	j.logs = append(j.logs, err.Error())
+	j.err = err
+	j.Failed = true
+}
+
+// active returns true if the job still needs work from the pipeline's stages.
+func (j *Job) active(ctx context.Context) bool {
+	return !j.Failed && !j.Skipped && ctx.Err() == nil
+}
+
+// Decode loads the screenshot, once cfg.Budget has room for it. If the cache
+// shows it hasn't changed since it was last converted, with all the outputs
+// cfg asks for, and cfg.Force isn't set, the job is skipped instead.
+func (j *Job) Decode(ctx context.Context, cfg *Config) {
+	if !j.active(ctx) {
+		return
+	}
+	data, err := os.ReadFile(j.In)
+	if err != nil {
+		j.fail(fmt.Errorf("Unable to open '%s': %v", j.In, err))
+		return
+	}
+	j.inputHash = FileFingerprint(data)
+	if cfg.Cache != nil && !cfg.Force {
+		e := cfg.Cache.Lookup(j.Out)
+		if e != nil && e.InputHash == j.inputHash && e.Refs == cfg.RefsVersion &&
+			e.Options == cfg.Options && e.hasOutputs(j.Out, cfg) {
+			j.Skipped = true
+			j.Theme = e.Theme
+			j.NPuzzles, j.NUnknown = e.Puzzles, e.Unknown
+			j.logf("Skipping unchanged '%s' (%s, %d puzzle pieces)",
+				j.In, e.Theme, e.Puzzles)
+			return
+		}
+	}
+	// Reserve memory for the decoded image before decoding it
+	ic, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		j.reserved = cfg.Budget.Acquire(int64(ic.Width) * int64(ic.Height) * 4)
+		j.img, _, err = image.Decode(bytes.NewReader(data))
 	}
-	dir, err := os.Open(inPath)
 	if err != nil {
-		log.Printf("Unable to open directory '%s': %v", inPath, err)
-		return 0
+		j.fail(fmt.Errorf("Unable to decode '%s': %v", j.In, err))
+	}
+	if cfg.Debug {
+		j.trace = &edshot.Trace{}
+	}
+}
+
+// Locate finds the map in the screenshot.
+func (j *Job) Locate(ctx context.Context) {
+	if !j.active(ctx) {
+		return
 	}
-	children, err := dir.Readdirnames(-1)
-	dir.Close()
+	var err error
+	j.grid, j.selBounds, j.scale, err = edshot.LocateMap(j.img, j.In, j.trace)
 	if err != nil {
-		log.Printf("Unable to read directory '%s': %v", inPath, err)
-		return 0
+		j.fail(err)
 	}
-	// Process level PNGs, but only process child directories if we're at the
-	// top-level (child == "")
-	numChildren := 0
-	madeDir := false
-	for _, c := range children {
-		var subPath string
-		if child == "" {
-			subPath = c
-		} else {
-			subPath = filepath.Join(child, c)
-		}
-		inPath = filepath.Join(inputRoot, subPath)
-		if isLevelPng(inPath) || child == "" {
-			if !madeDir {
-				madeDir = true
-				var d string
-				if child == "" {
-					d = outputRoot
-				} else {
-					d = filepath.Join(outputRoot, child)
-				}
-				err := os.MkdirAll(d, 0755)
-				if err != nil {
-					log.Printf("Unable to create output directory '%s': %v",
-						d, err)
-				}
+}
+
+// Classify works out the map's theme and what each tile represents using
+// cfg, with edshot.ClassifyMap. Unrecognised tiles count as puzzle pieces if
+// cfg.UnknownAsPuzzle is set.
+func (j *Job) Classify(ctx context.Context, cfg *Config) {
+	if !j.active(ctx) {
+		return
+	}
+	mc, err := edshot.ClassifyMap(j.img, j.In, j.grid, j.selBounds, j.scale,
+		cfg.RefTiles, cfg.Classifier, j.trace)
+	if err != nil {
+		j.fail(err)
+		return
+	}
+	j.theme, j.hashes, j.classes = mc.Theme, mc.Hashes, mc.Tiles
+	j.Theme = mc.ThemeName()
+	w := mc.Width
+	j.logf("Map '%s' is %s (by %s, margin %.3f) and %d x %d at scale %g",
+		j.In, j.Theme, j.theme.Method, j.theme.Margin, w, mc.Height, j.scale)
+	j.m = mc.Map(cfg.UnknownAsPuzzle)
+	nInexact := 0
+	worst := 1.0
+	for i, c := range j.classes {
+		switch c.Method {
+		case edshot.METHOD_NONE:
+			j.NUnknown++
+			if cfg.Learner != nil {
+				cfg.Learner.Add(j.Theme, j.hashes[i], j.img, j.grid, j.In,
+					i%w, i/w)
 			}
-			numChildren += ProcessRecursive(inputRoot, outputRoot, subPath,
-				refTiles, ch)
-		} else {
-			log.Printf("Skipping '%s'", inPath)
+		case edshot.METHOD_HASH:
+		default:
+			nInexact++
+			worst = min(worst, c.Confidence)
 		}
+		// Count from the classification rather than j.m so that the count
+		// doesn't depend on cfg.UnknownAsPuzzle
+		if c.Tile == repton2.T_PUZZLE || c.Tile == repton2.T_UNKNOWN {
+			j.NPuzzles++
+		}
+	}
+	if nInexact != 0 {
+		j.logf("%s: %d tiles were matched inexactly, lowest confidence %f",
+			j.In, nInexact, worst)
 	}
-	return numChildren
 }
 
-// LoadRefHashes loads reference hashes from a JSON file.
-func LoadRefHashes(filename string) (map[string][]uint32, error) {
-	fd, err := os.Open(filename)
+// Write saves the text file representation of the map, and the report and
+// debug image if enabled in cfg. Then it frees the screenshot.
+func (j *Job) Write(ctx context.Context, cfg *Config) {
+	defer func() {
+		j.img = nil
+		cfg.Budget.Release(j.reserved)
+		j.reserved = 0
+	}()
+	if ctx.Err() != nil || j.Skipped {
+		return
+	}
+	// The debug image is saved even if the screenshot couldn't be analysed
+	debugSaved := false
+	if j.trace != nil && j.img != nil {
+		err := SaveDebugImage(debugFilename(j.Out), j.img, j.trace)
+		if err != nil {
+			j.logf("%v", err)
+		} else {
+			debugSaved = true
+		}
+	}
+	if j.Failed {
+		cfg.Cache.Update(j.Out, nil)
+		return
+	}
+	if err := repton.WriteFileAtomic(j.Out, j.m.WriteASCII); err != nil {
+		j.fail(fmt.Errorf("Failed to save map: %v", err))
+		cfg.Cache.Update(j.Out, nil)
+		return
+	}
+	reportSaved := false
+	if cfg.WriteReports {
+		err := WriteMapReport(reportFilename(j.Out), j.In, j.m, j.theme,
+			j.classes)
+		if err != nil {
+			j.logf("%v", err)
+		} else {
+			reportSaved = true
+		}
+	}
+	j.logf("%s contains %d puzzle pieces and %d unrecognised tiles",
+		j.In, j.NPuzzles, j.NUnknown)
+	j.Converted = true
+	// Orphans checks the input, which may not be relative to the same folder
+	input, err := filepath.Abs(j.In)
 	if err != nil {
-		return nil, err
+		input = j.In
+	}
+	cfg.Cache.Update(j.Out, &CacheEntry{
+		Input:     input,
+		InputHash: j.inputHash,
+		Refs:      cfg.RefsVersion,
+		Options:   cfg.Options,
+		Theme:     j.m.Theme,
+		Puzzles:   j.NPuzzles,
+		Unknown:   j.NUnknown,
+		Report:    reportSaved,
+		Debug:     debugSaved,
+	})
+}
+
+// Report outputs the job's log.
+func (j *Job) Report() {
+	for _, msg := range j.logs {
+		log.Println(msg)
+	}
+}
+
+// Summary describes the result of the job in one line.
+func (j *Job) Summary() string {
+	switch {
+	case j.Failed:
+		return fmt.Sprintf("FAILED: %v", j.err)
+	case j.Skipped:
+		return fmt.Sprintf("%s: unchanged, %s, %d puzzle pieces", j.In,
+			j.Theme, j.NPuzzles)
+	}
+	return fmt.Sprintf("%s: %s, %d x %d, %d puzzle pieces, "+
+		"%d unrecognised tiles", j.In, j.Theme, j.grid.Columns, j.grid.Rows,
+		j.NPuzzles, j.NUnknown)
+}
+
+// LevelRecord is the line of the run summary (see WriteRunSummary) for one
+// screenshot. Rectangles are [x0, y0, x1, y1] in the screenshot's pixels.
+// Fields which weren't found before the screenshot failed, or which aren't
+// in the cache if it was skipped, are left out.
+type LevelRecord struct {
+	Type        string  `json:"type"` // "level"
+	Input       string  `json:"input"`
+	Output      string  `json:"output"`
+	Skipped     bool    `json:"skipped,omitempty"`
+	Theme       string  `json:"theme,omitempty"`
+	ThemeMethod string  `json:"theme_method,omitempty"`
+	Scale       float64 `json:"scale,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Puzzles     int     `json:"puzzles"`
+	Unknown     int     `json:"unknown"`
+	Error       string  `json:"error,omitempty"`
+	Selecters   []int   `json:"selecters,omitempty"`
+	Map         []int   `json:"map,omitempty"`
+}
+
+// ScenarioRecord is the line of the run summary totalling the levels in one
+// folder. Expected is the default number of puzzle pieces in a scenario.
+type ScenarioRecord struct {
+	Type     string `json:"type"` // "scenario"
+	Scenario string `json:"scenario"`
+	Levels   int    `json:"levels"`
+	Failed   int    `json:"failed"`
+	Puzzles  int    `json:"puzzles"`
+	Expected int    `json:"expected"`
+}
+
+// TotalRecord is the last line of the run summary.
+type TotalRecord struct {
+	Type        string `json:"type"` // "total"
+	Levels      int    `json:"levels"`
+	Failed      int    `json:"failed"`
+	Skipped     int    `json:"skipped"`
+	Puzzles     int    `json:"puzzles"`
+	Interrupted bool   `json:"interrupted,omitempty"`
+}
+
+// rectRecord converts r to the form used in LevelRecord, or nil if it's
+// empty.
+func rectRecord(r image.Rectangle) []int {
+	if r.Empty() {
+		return nil
+	}
+	return []int{r.Min.X, r.Min.Y, r.Max.X, r.Max.Y}
+}
+
+// Finished returns true if the job was converted, skipped or failed, ie it
+// wasn't cut short by an interrupt.
+func (j *Job) Finished() bool {
+	return j.Converted || j.Skipped || j.Failed
+}
+
+// Record returns the job's LevelRecord.
+func (j *Job) Record() *LevelRecord {
+	r := &LevelRecord{
+		Type:      "level",
+		Input:     j.In,
+		Output:    j.Out,
+		Skipped:   j.Skipped,
+		Theme:     j.Theme,
+		Scale:     float64(j.scale),
+		Width:     j.grid.Columns,
+		Height:    j.grid.Rows,
+		Puzzles:   j.NPuzzles,
+		Unknown:   j.NUnknown,
+		Selecters: rectRecord(j.selBounds),
+		Map:       rectRecord(j.grid.Bounds),
+	}
+	if j.Theme != "" && !j.Skipped {
+		r.ThemeMethod = j.theme.Method
+	}
+	if j.err != nil {
+		r.Error = j.err.Error()
+	}
+	return r
+}
+
+// ScenarioTotals totals the finished jobs in each folder, in order of each
+// folder's first job.
+func ScenarioTotals(jobs []*Job) []*ScenarioRecord {
+	var totals []*ScenarioRecord
+	byDir := make(map[string]*ScenarioRecord)
+	for _, j := range jobs {
+		if !j.Finished() {
+			continue
+		}
+		dir := filepath.Dir(j.In)
+		t := byDir[dir]
+		if t == nil {
+			t = &ScenarioRecord{
+				Type:     "scenario",
+				Scenario: dir,
+				Expected: repton2.PUZZLE_WIDTH * repton2.PUZZLE_HEIGHT,
+			}
+			byDir[dir] = t
+			totals = append(totals, t)
+		}
+		t.Levels++
+		if j.Failed {
+			t.Failed++
+		}
+		t.Puzzles += j.NPuzzles
+	}
+	return totals
+}
+
+// WriteRunSummary writes a summary of the finished jobs as newline-delimited
+// JSON: a LevelRecord for each job, then a ScenarioRecord for each folder,
+// then a TotalRecord. interrupted is whether the run was interrupted.
+func WriteRunSummary(w io.Writer, jobs []*Job, interrupted bool) error {
+	enc := json.NewEncoder(w)
+	total := &TotalRecord{Type: "total", Interrupted: interrupted}
+	for _, j := range jobs {
+		if !j.Finished() {
+			continue
+		}
+		if err := enc.Encode(j.Record()); err != nil {
+			return err
+		}
+		total.Levels++
+		if j.Failed {
+			total.Failed++
+		}
+		if j.Skipped {
+			total.Skipped++
+		}
+		total.Puzzles += j.NPuzzles
+	}
+	for _, t := range ScenarioTotals(jobs) {
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(total)
+}
+
+// runStage starts workers goroutines which call process for each job from in,
+// then pass it on to the returned channel. Jobs which have failed, or are
+// cancelled, are still passed on so that they can be reported and their
+// resources released.
+func runStage(in <-chan *Job, workers int, process func(*Job)) <-chan *Job {
+	out := make(chan *Job, workers)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range in {
+				process(j)
+				out <- j
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// RunPipeline converts the screenshots described by jobs in a pipeline of
+// stages: decode, locate, classify and write. Each stage has cfg.Workers
+// goroutines, and the number of screenshots in memory at once is limited by
+// cfg.Budget. The jobs are reported in the order of their Index, which must
+// count up from 0, with their Summary if cfg.Summarise is set. If ctx is
+// cancelled, jobs which haven't started are skipped, but no file is left
+// half-written. The result is the jobs which were reported.
+func RunPipeline(ctx context.Context, jobs <-chan *Job, cfg *Config) []*Job {
+	decoded := runStage(jobs, cfg.Workers,
+		func(j *Job) { j.Decode(ctx, cfg) })
+	located := runStage(decoded, cfg.Workers,
+		func(j *Job) { j.Locate(ctx) })
+	classified := runStage(located, cfg.Workers,
+		func(j *Job) { j.Classify(ctx, cfg) })
+	written := runStage(classified, cfg.Workers,
+		func(j *Job) { j.Write(ctx, cfg) })
+	var done []*Job
+	pending := make(map[int]*Job)
+	for j := range written {
+		pending[j.Index] = j
+		for j = pending[len(done)]; j != nil; j = pending[len(done)] {
+			delete(pending, j.Index)
+			if !cfg.Summarise {
+				j.Report()
+			} else if ctx.Err() == nil {
+				log.Println(j.Summary())
+			}
+			done = append(done, j)
+		}
+	}
+	return done
+}
+
+// DEFAULT_PATTERN matches the names of level screenshots by default, eg
+// "07.png".
+const DEFAULT_PATTERN = `^(\d\d)\.png$`
+
+// DEFAULT_OUTPUT_TEMPLATE names each text file after its screenshot, in a
+// folder mirroring the screenshot's.
+const DEFAULT_OUTPUT_TEMPLATE = "{{.Dir}}/{{.Name}}.txt"
+
+// OutputName is the data passed to LevelFinder.OutputTemplate. Dir is the
+// screenshot's folder relative to the input folder, with '/' separators, or
+// "." if it's the input folder itself. Name is the screenshot's filename
+// without its extension, and Level the level number taken from its name.
+type OutputName struct {
+	Dir   string
+	Name  string
+	Level int
+}
+
+// LevelFinder finds level screenshots in the Input folder and its subfolders,
+// to a depth of Depth (or any depth if Depth is negative), and works out the
+// names of the text files in the Output folder by executing OutputTemplate
+// with an OutputName. A screenshot's filename must match one of Patterns,
+// whose first group is the level number. Include and Exclude are globs (see
+// path.Match); a glob containing '/' is matched against the path relative to
+// Input, otherwise against the filename. If Include is not empty, a
+// screenshot must match one of its globs, and screenshots and folders which
+// match any of Exclude are skipped. Problems are reported with Logf.
+type LevelFinder struct {
+	Input, Output    string
+	Patterns         []*regexp.Regexp
+	Depth            int
+	Include, Exclude []string
+	OutputTemplate   *template.Template
+	Logf             func(format string, args ...any)
+}
+
+// NewLevelFinder creates a LevelFinder with the default settings, which find
+// screenshots named like "01.png" in input and the folders in it, to be
+// converted to text files of the same names in output.
+func NewLevelFinder(input, output string) *LevelFinder {
+	return &LevelFinder{
+		Input:    input,
+		Output:   output,
+		Patterns: []*regexp.Regexp{regexp.MustCompile(DEFAULT_PATTERN)},
+		Depth:    1,
+		OutputTemplate: template.Must(
+			template.New("output").Parse(DEFAULT_OUTPUT_TEMPLATE)),
+		Logf: log.Printf,
+	}
+}
+
+// CompilePatterns compiles regular expressions for LevelFinder.Patterns,
+// checking that each has a group for the level number.
+func CompilePatterns(exprs []string) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("pattern '%s' has no group for the "+
+				"level number", expr)
+		}
+		patterns[i] = re
+	}
+	return patterns, nil
+}
+
+// CheckGlobs returns an error if any of globs is malformed.
+func CheckGlobs(globs []string) error {
+	for _, g := range globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("bad glob '%s': %v", g, err)
+		}
+	}
+	return nil
+}
+
+// matchesGlob returns true if relPath (relative to Input, with '/'
+// separators) matches any of globs.
+func matchesGlob(globs []string, relPath string) bool {
+	for _, g := range globs {
+		name := relPath
+		if !strings.Contains(g, "/") {
+			name = path.Base(relPath)
+		}
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Level returns the level number of a screenshot's filename, and whether it
+// matches any of the Patterns.
+func (f *LevelFinder) Level(filename string) (int, bool) {
+	leafname := filepath.Base(filename)
+	for _, re := range f.Patterns {
+		m := re.FindStringSubmatch(leafname)
+		if m == nil {
+			continue
+		}
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// OutputFor returns the output filename for a screenshot, given its path
+// relative to Input.
+func (f *LevelFinder) OutputFor(relPath string, level int) (string, error) {
+	leafname := path.Base(relPath)
+	name := OutputName{
+		Dir:   path.Dir(relPath),
+		Name:  strings.TrimSuffix(leafname, path.Ext(leafname)),
+		Level: level,
+	}
+	buf := &strings.Builder{}
+	if err := f.OutputTemplate.Execute(buf, &name); err != nil {
+		return "", err
 	}
-	defer fd.Close()
-	str, err := io.ReadAll(fd)
+	out := filepath.Clean(filepath.FromSlash(buf.String()))
+	if out == "." || filepath.IsAbs(out) || out == ".." ||
+		strings.HasPrefix(out, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside the output folder", out)
+	}
+	return filepath.Join(f.Output, out), nil
+}
+
+// Find finds the screenshots and calls emit with the input and output
+// filenames of each one, in sorted order, creating output folders as
+// necessary. If emit returns false, Find stops and returns false. If Input is
+// a file rather than a folder, Output may be an existing folder, in which case
+// the text file is named by OutputTemplate as usual, otherwise Output names
+// the text file, with its extension replaced by ".txt".
+func (f *LevelFinder) Find(emit func(inPath, outPath string) bool) bool {
+	info, err := os.Stat(f.Input)
 	if err != nil {
-		return nil, err
+		f.Logf("Unable to read '%s': %v", f.Input, err)
+		return true
+	}
+	if !info.IsDir() {
+		level, ok := f.Level(f.Input)
+		if !ok {
+			f.Logf("'%s' isn't named like a level screenshot", f.Input)
+			return true
+		}
+		if !isDir(f.Output) {
+			return emit(f.Input,
+				strings.TrimSuffix(f.Output, filepath.Ext(f.Output))+".txt")
+		}
+		outPath, err := f.OutputFor(filepath.Base(f.Input), level)
+		if err != nil {
+			f.Logf("Unable to name output for '%s': %v", f.Input, err)
+			return true
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			f.Logf("Unable to create output directory '%s': %v",
+				filepath.Dir(outPath), err)
+		}
+		return emit(f.Input, outPath)
 	}
-	refs := make(map[string][]uint32)
-	err = json.Unmarshal(str, &refs)
+	seen := make(map[string]string)
+	return f.find("", 0, seen, emit)
+}
+
+// find searches the folder relDir, at the given depth below Input. seen maps
+// each output filename to its input, to catch clashes.
+func (f *LevelFinder) find(relDir string, depth int, seen map[string]string,
+	emit func(inPath, outPath string) bool,
+) bool {
+	dir := filepath.Join(f.Input, filepath.FromSlash(relDir))
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, err
+		f.Logf("Unable to read directory '%s': %v", dir, err)
+		return true
+	}
+	for _, e := range entries {
+		relPath := path.Join(relDir, e.Name())
+		inPath := filepath.Join(dir, e.Name())
+		if matchesGlob(f.Exclude, relPath) {
+			continue
+		}
+		if e.IsDir() {
+			if f.Depth >= 0 && depth >= f.Depth {
+				f.Logf("Skipping '%s'", inPath)
+			} else if !f.find(relPath, depth+1, seen, emit) {
+				return false
+			}
+			continue
+		}
+		level, ok := f.Level(e.Name())
+		if !ok {
+			f.Logf("Skipping '%s'", inPath)
+			continue
+		}
+		if len(f.Include) != 0 && !matchesGlob(f.Include, relPath) {
+			continue
+		}
+		outPath, err := f.OutputFor(relPath, level)
+		if err != nil {
+			f.Logf("Unable to name output for '%s': %v", inPath, err)
+			continue
+		}
+		if other, ok := seen[outPath]; ok {
+			f.Logf("Skipping '%s' because '%s' is also output as '%s'",
+				inPath, other, outPath)
+			continue
+		}
+		seen[outPath] = inPath
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			f.Logf("Unable to create output directory '%s': %v",
+				filepath.Dir(outPath), err)
+		}
+		if !emit(inPath, outPath) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDir returns true if filename is an existing folder.
+func isDir(filename string) bool {
+	info, err := os.Stat(filename)
+	return err == nil && info.IsDir()
+}
+
+// stringList is a flag which may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// fileState is what Watcher uses to tell whether a file has changed.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// Watcher polls for level screenshots which are new or have been modified,
+// using a LevelFinder.
+type Watcher struct {
+	finder  LevelFinder
+	seen    map[string]fileState // When last returned by Poll
+	changed map[string]fileState // When a change was noticed
+	logged  map[string]bool
+}
+
+// NewWatcher creates a Watcher which finds screenshots with a copy of finder.
+// Every screenshot that's already there counts as new.
+func NewWatcher(finder *LevelFinder) *Watcher {
+	w := &Watcher{
+		finder:  *finder,
+		seen:    make(map[string]fileState),
+		changed: make(map[string]fileState),
+		logged:  make(map[string]bool),
+	}
+	w.finder.Logf = w.logf
+	return w
+}
+
+// logf logs each distinct message once, so that problems with the folders
+// aren't repeated on every poll.
+func (w *Watcher) logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if !w.logged[msg] {
+		w.logged[msg] = true
+		log.Println(msg)
+	}
+}
+
+// Poll returns jobs for the screenshots which have changed since they were
+// last returned. A screenshot is only returned once its size and
+// modification time are the same as at the previous poll, so that one which
+// is still being written isn't read.
+func (w *Watcher) Poll() []*Job {
+	var jobs []*Job
+	present := make(map[string]bool)
+	w.finder.Find(func(inPath, outPath string) bool {
+		info, err := os.Stat(inPath)
+		if err != nil {
+			return true
+		}
+		present[inPath] = true
+		state := fileState{info.Size(), info.ModTime()}
+		if state == w.seen[inPath] {
+			delete(w.changed, inPath)
+		} else if prev, ok := w.changed[inPath]; ok && prev == state {
+			delete(w.changed, inPath)
+			w.seen[inPath] = state
+			jobs = append(jobs, &Job{Index: len(jobs), In: inPath, Out: outPath})
+		} else {
+			w.changed[inPath] = state
+		}
+		return true
+	})
+	// Forget deleted screenshots so that they count as new if replaced
+	for inPath := range w.seen {
+		if !present[inPath] {
+			delete(w.seen, inPath)
+		}
+	}
+	for inPath := range w.changed {
+		if !present[inPath] {
+			delete(w.changed, inPath)
+		}
+	}
+	return jobs
+}
+
+// Watch polls the input every interval with a Watcher, converting the new and
+// modified screenshots it finds, until ctx is cancelled. The cache is saved
+// after each batch.
+func Watch(ctx context.Context, w *Watcher, cfg *Config,
+	interval time.Duration,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if batch := w.Poll(); len(batch) != 0 {
+			jobs := make(chan *Job, len(batch))
+			for _, j := range batch {
+				jobs <- j
+			}
+			close(jobs)
+			RunPipeline(ctx, jobs, cfg)
+			if err := cfg.Cache.Save(); err != nil {
+				log.Printf("Failed to save cache: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
-	return refs, nil
 }
 
 func main() {
-	if len(os.Args) != 4 {
-		log.Println("img2map takes 3 arguments: ")
-		log.Fatalln("input folder, output folder, reference tiles JSON")
+	spritesDir := flag.String("sprites", "",
+		"Folder of reference sprites for fuzzy matching")
+	threshold := flag.Float64("threshold", edshot.FUZZY_THRESHOLD,
+		"Maximum distance (0-1) for fuzzy matching")
+	unknownAsPuzzle := flag.Bool("unknown-as-puzzle", true,
+		"Output unrecognised tiles as puzzle pieces instead of '?'")
+	debug := flag.Bool("debug", false,
+		"Save an annotated copy of each screenshot showing how it was "+
+			"analysed")
+	samplesDir := flag.String("samples", "",
+		"Folder of labelled tiles saved by -learn for nearest neighbour "+
+			"matching")
+	neighbours := flag.Int("neighbours", edshot.NEAREST_K,
+		"Number of nearest samples which vote in -samples matching")
+	learnDir := flag.String("learn", "",
+		"Save each distinct unrecognised tile in this folder")
+	workers := flag.Int("workers", runtime.NumCPU(),
+		"Number of screenshots to work on at once in each stage")
+	maxMemory := flag.Int("max-memory", 1024,
+		"Approximate limit (MB) of memory used by decoded screenshots")
+	writeReports := flag.Bool("report", false,
+		"Write a JSON report of each tile's classification alongside "+
+			"each text file")
+	force := flag.Bool("force", false,
+		"Convert all screenshots, even if unchanged since the last run")
+	watch := flag.Bool("watch", false,
+		"Keep watching the input for new or modified screenshots until "+
+			"interrupted")
+	interval := flag.Duration("interval", time.Second,
+		"How often to check for new screenshots with -watch")
+	var patterns, include, exclude stringList
+	flag.Var(&patterns, "pattern",
+		"Regular expression matching the filenames of level screenshots, "+
+			"with a group for the level number; may be repeated (default "+
+			DEFAULT_PATTERN+")")
+	flag.Var(&include, "include",
+		"Only convert screenshots matching this glob; may be repeated")
+	flag.Var(&exclude, "exclude",
+		"Skip screenshots and folders matching this glob; may be repeated")
+	depth := flag.Int("depth", 1,
+		"How many levels of subfolders to search for screenshots (-1 for "+
+			"any)")
+	outputTemplate := flag.String("output-template", DEFAULT_OUTPUT_TEMPLATE,
+		"Template for the name of each text file relative to the output "+
+			"folder, with fields .Dir, .Name and .Level")
+	summaryFile := flag.String("summary", "",
+		"Write a summary of the run in newline-delimited JSON to this file "+
+			"('-' for stdout)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: img2map [options] "+
+			"input reference_tiles.json output")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *watch && *summaryFile != "" {
+		log.Fatalln("-summary can't be used with -watch")
+	}
+	cfg := &Config{
+		Workers:         max(*workers, 1),
+		Budget:          NewMemoryBudget(int64(*maxMemory) << 20),
+		UnknownAsPuzzle: *unknownAsPuzzle,
+		WriteReports:    *writeReports,
+		Debug:           *debug,
+		Summarise:       *watch,
+		// Learning needs to see every tile
+		Force: *force || *learnDir != "",
+		Options: fmt.Sprintf("sprites=%s samples=%s neighbours=%d "+
+			"threshold=%g unknown-as-puzzle=%t report=%t debug=%t",
+			*spritesDir, *samplesDir, *neighbours, *threshold,
+			*unknownAsPuzzle, *writeReports, *debug),
 	}
-	refTiles, err := LoadRefHashes(os.Args[2])
+	refData, err := os.ReadFile(flag.Arg(1))
 	if err != nil {
-		log.Fatalf("Failed to load/parse reference tiles: %v", err)
+		log.Fatalf("Failed to load reference tiles: %v", err)
 	}
-	ch := make(chan int, 32)
-	numChildren := ProcessRecursive(os.Args[1], os.Args[3], "", refTiles, ch)
+	refs, header, err := edshot.ParseRefHashes(refData)
+	if err != nil {
+		log.Fatalf("Failed to parse reference tiles: %v", err)
+	}
+	cfg.RefTiles = refs
+	refsFormat := 1
+	if header != nil {
+		refsFormat = header.Format
+	}
+	cfg.RefsVersion = fmt.Sprintf("v%d:%s", refsFormat,
+		FileFingerprint(refData))
+	chain := edshot.ChainClassifier{edshot.NewHashClassifier(cfg.RefTiles)}
+	if *spritesDir != "" {
+		set, err := sprites.LoadDir(*spritesDir)
+		if err != nil {
+			log.Fatalf("Failed to load reference sprites: %v", err)
+		}
+		chain = append(chain, &edshot.FuzzyClassifier{
+			Sprites: set, Threshold: *threshold})
+	}
+	if *samplesDir != "" {
+		samples, err := edshot.LoadLabelledSamples(*samplesDir)
+		if err != nil {
+			log.Fatalf("Failed to load labelled samples: %v", err)
+		}
+		chain = append(chain, &edshot.NearestClassifier{
+			Samples: samples, K: *neighbours, Threshold: *threshold})
+	}
+	cfg.Classifier = chain
+	if *learnDir != "" {
+		cfg.Learner = NewLearner()
+	}
+	finder := NewLevelFinder(flag.Arg(0), flag.Arg(2))
+	finder.Depth = *depth
+	finder.Include, finder.Exclude = include, exclude
+	if len(patterns) != 0 {
+		finder.Patterns, err = CompilePatterns(patterns)
+		if err != nil {
+			log.Fatalf("Invalid -pattern: %v", err)
+		}
+	}
+	if err := CheckGlobs(append(include, exclude...)); err != nil {
+		log.Fatalf("Invalid -include or -exclude: %v", err)
+	}
+	finder.OutputTemplate, err = template.New("output").Parse(*outputTemplate)
+	if err != nil {
+		log.Fatalf("Invalid -output-template: %v", err)
+	}
+	if !isDir(flag.Arg(0)) && !isDir(flag.Arg(2)) {
+		cfg.Cache = LoadCache(filepath.Dir(flag.Arg(2)))
+	} else {
+		cfg.Cache = LoadCache(flag.Arg(2))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		// Let a second interrupt kill img2map immediately
+		<-ctx.Done()
+		stop()
+	}()
+	if *watch {
+		log.Printf("Watching '%s' for screenshots; press Ctrl-C to stop",
+			flag.Arg(0))
+		Watch(ctx, NewWatcher(finder), cfg, *interval)
+		log.Println("Stopped watching")
+		saveLearned(cfg.Learner, *learnDir)
+		return
+	}
+	jobs := make(chan *Job)
+	go func() {
+		defer close(jobs)
+		index := 0
+		finder.Find(func(inPath, outPath string) bool {
+			select {
+			case jobs <- &Job{Index: index, In: inPath, Out: outPath}:
+				index++
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
 	nPuzzles := 0
-	for n := 0; n < numChildren; n++ {
-		nPuzzles += <-ch
+	nSkipped := 0
+	nFailed := 0
+	done := RunPipeline(ctx, jobs, cfg)
+	for _, j := range done {
+		nPuzzles += j.NPuzzles
+		if j.Skipped {
+			nSkipped++
+		}
+		if j.Failed {
+			nFailed++
+		}
+	}
+	if *summaryFile != "" {
+		write := func(w io.Writer) error {
+			return WriteRunSummary(w, done, ctx.Err() != nil)
+		}
+		var err error
+		if *summaryFile == "-" {
+			err = write(os.Stdout)
+		} else {
+			err = repton.WriteFileAtomic(*summaryFile, write)
+		}
+		if err != nil {
+			log.Printf("Failed to write summary: %v", err)
+		}
+	}
+	for _, out := range cfg.Cache.Orphans() {
+		log.Printf("The source of '%s' no longer exists", out)
+	}
+	if err := cfg.Cache.Save(); err != nil {
+		log.Printf("Failed to save cache: %v", err)
+	}
+	if ctx.Err() != nil {
+		log.Fatalln("Interrupted")
+	}
+	if nSkipped != 0 {
+		log.Printf("Skipped %d unchanged screenshots", nSkipped)
+	}
+	for _, t := range ScenarioTotals(done) {
+		if t.Puzzles != t.Expected {
+			log.Printf("'%s' has %d puzzle pieces in %d levels, expected %d",
+				t.Scenario, t.Puzzles, t.Levels, t.Expected)
+		}
 	}
 	log.Printf("Found a total of %d puzzle pieces", nPuzzles)
+	saveLearned(cfg.Learner, *learnDir)
+	if nFailed != 0 {
+		log.Fatalf("Failed to convert %d screenshots", nFailed)
+	}
+}
+
+// saveLearned saves the tiles collected by learner, if not nil, in dir.
+func saveLearned(learner *Learner, dir string) {
+	if learner == nil {
+		return
+	}
+	if err := learner.Save(dir); err != nil {
+		log.Fatalf("Failed to save learned tiles: %v", err)
+	}
+	log.Printf("Saved %d distinct unrecognised tiles in '%s'",
+		len(learner.tiles), dir)
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"text/template"
+
+	"github.com/realh/repmap/pkg/edshot"
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+// writeTestPNG saves a small PNG whose content depends on shade.
+func writeTestPNG(t *testing.T, filename string, shade uint8) {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	if err := repton.SavePNG(img, filename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	c := LoadCache(dir)
+	if len(c.Entries) != 0 {
+		t.Fatalf("new cache has %d entries", len(c.Entries))
+	}
+	out := filepath.Join(dir, "Jungle", "01.txt")
+	entry := &CacheEntry{Input: "in/01.png", InputHash: "abc", Refs: "v2:x",
+		Theme: "Green", Puzzles: 5}
+	c.Update(out, entry)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c = LoadCache(dir)
+	if e := c.Lookup(out); e == nil || !reflect.DeepEqual(*e, *entry) {
+		t.Errorf("loaded entry %+v, expected %+v", e, entry)
+	}
+	if _, ok := c.Entries["Jungle/01.txt"]; !ok {
+		t.Errorf("entry isn't keyed relative to the cache: %v", c.Entries)
+	}
+	c.Update(out, nil)
+	if c.Lookup(out) != nil {
+		t.Errorf("entry wasn't removed")
+	}
+}
+
+// writeAux creates a placeholder for a report or debug image.
+func writeAux(t *testing.T, filename string) {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheHitAndMiss(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "01.png")
+	out := filepath.Join(dir, "out", "01.txt")
+	writeTestPNG(t, in, 0)
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(out, []byte("Blue\n.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCfg := func() *Config {
+		cfg := &Config{Budget: NewMemoryBudget(1 << 20), RefsVersion: "refs",
+			Options: "opts", Cache: LoadCache(filepath.Dir(out))}
+		cfg.Cache.Update(out, &CacheEntry{Input: in,
+			InputHash: FileFingerprint(data), Refs: "refs", Options: "opts",
+			Theme: "Blue", Puzzles: 3})
+		return cfg
+	}
+	tests := []struct {
+		name    string
+		change  func(cfg *Config)
+		skipped bool
+	}{
+		{"unchanged", func(cfg *Config) {}, true},
+		{"forced", func(cfg *Config) { cfg.Force = true }, false},
+		{"input changed", func(cfg *Config) { writeTestPNG(t, in, 1) }, false},
+		{"refs changed", func(cfg *Config) { cfg.RefsVersion = "new" }, false},
+		{"options changed", func(cfg *Config) { cfg.Options = "new" }, false},
+		{"output deleted", func(cfg *Config) { os.Remove(out) }, false},
+		{"not cached", func(cfg *Config) { cfg.Cache.Update(out, nil) }, false},
+		{"report wanted", func(cfg *Config) { cfg.WriteReports = true }, false},
+		{"debug wanted", func(cfg *Config) { cfg.Debug = true }, false},
+		{"report saved", func(cfg *Config) {
+			cfg.WriteReports = true
+			cfg.Cache.Lookup(out).Report = true
+			writeAux(t, reportFilename(out))
+		}, true},
+		{"report deleted", func(cfg *Config) {
+			cfg.WriteReports = true
+			cfg.Cache.Lookup(out).Report = true
+			os.Remove(reportFilename(out))
+		}, false},
+		{"report not recorded", func(cfg *Config) {
+			cfg.WriteReports = true
+			writeAux(t, reportFilename(out))
+		}, false},
+		{"debug saved", func(cfg *Config) {
+			cfg.Debug = true
+			cfg.Cache.Lookup(out).Debug = true
+			writeAux(t, debugFilename(out))
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeTestPNG(t, in, 0)
+			if err := os.WriteFile(out, []byte("Blue\n.\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := newCfg()
+			test.change(cfg)
+			j := &Job{In: in, Out: out}
+			j.Decode(context.Background(), cfg)
+			if j.Failed {
+				t.Fatal(j.err)
+			}
+			if j.Skipped != test.skipped {
+				t.Errorf("skipped is %t, expected %t", j.Skipped, test.skipped)
+			}
+			if j.Skipped && (j.Theme != "Blue" || j.NPuzzles != 3) {
+				t.Errorf("skipped job has theme %s and %d puzzle pieces",
+					j.Theme, j.NPuzzles)
+			}
+			if !j.Skipped && j.img == nil {
+				t.Errorf("job wasn't skipped but the image wasn't decoded")
+			}
+		})
+	}
+}
+
+func TestCacheOrphans(t *testing.T) {
+	dir := t.TempDir()
+	c := LoadCache(dir)
+	// 01 is still there; 02's input has gone but its output is still there;
+	// both of 03's files have gone
+	for _, name := range []string{"01", "02", "03"} {
+		in := filepath.Join(dir, name+".png")
+		out := filepath.Join(dir, name+".txt")
+		writeTestPNG(t, in, 0)
+		if err := os.WriteFile(out, []byte("Blue\n.\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c.Update(out, &CacheEntry{Input: in})
+	}
+	os.Remove(filepath.Join(dir, "02.png"))
+	os.Remove(filepath.Join(dir, "03.png"))
+	os.Remove(filepath.Join(dir, "03.txt"))
+	orphans := c.Orphans()
+	expected := []string{filepath.Join(dir, "02.txt")}
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("orphans are %v, expected %v", orphans, expected)
+	}
+	if _, ok := c.Entries["03.txt"]; ok {
+		t.Errorf("entry for 03 wasn't forgotten")
+	}
+	if _, ok := c.Entries["02.txt"]; !ok {
+		t.Errorf("entry for 02 was forgotten")
+	}
+}
+
+func TestLevelFinderLevel(t *testing.T) {
+	f := NewLevelFinder("in", "out")
+	var err error
+	f.Patterns, err = CompilePatterns([]string{DEFAULT_PATTERN,
+		`^Level (\d+)\.png$`, `^scenario-(\d+)\.png$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filename string
+		level    int
+		ok       bool
+	}{
+		{"07.png", 7, true},
+		{"Level 7.png", 7, true},
+		{"dir/scenario-07.png", 7, true},
+		{"Level 12.png", 12, true},
+		{"7.png", 0, false},
+		{"Level 7.png.bak", 0, false},
+		{"scenario-07.jpg", 0, false},
+	}
+	for _, test := range tests {
+		level, ok := f.Level(test.filename)
+		if level != test.level || ok != test.ok {
+			t.Errorf("%s is level %d (%t), expected %d (%t)", test.filename,
+				level, ok, test.level, test.ok)
+		}
+	}
+	if _, err := CompilePatterns([]string{`^\d\d\.png$`}); err == nil {
+		t.Errorf("pattern without a group was accepted")
+	}
+}
+
+func TestLevelFinderFind(t *testing.T) {
+	in := t.TempDir()
+	for _, name := range []string{
+		"01.png",
+		"Jungle/02.png",
+		"Jungle/notes.txt",
+		"Jungle/Old/03.png",
+		"Jungle/Old/Older/04.png",
+		"Desert/05.png",
+		"Desert/06.png",
+	} {
+		filename := filepath.Join(in, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestPNG(t, filename, 0)
+	}
+	tests := []struct {
+		name     string
+		setup    func(f *LevelFinder)
+		expected []string
+	}{
+		{"default", func(f *LevelFinder) {},
+			[]string{"01.txt", "Desert/05.txt", "Desert/06.txt",
+				"Jungle/02.txt"}},
+		{"depth 0", func(f *LevelFinder) { f.Depth = 0 },
+			[]string{"01.txt"}},
+		{"depth 2", func(f *LevelFinder) { f.Depth = 2 },
+			[]string{"01.txt", "Desert/05.txt", "Desert/06.txt",
+				"Jungle/02.txt", "Jungle/Old/03.txt"}},
+		{"any depth", func(f *LevelFinder) { f.Depth = -1 },
+			[]string{"01.txt", "Desert/05.txt", "Desert/06.txt",
+				"Jungle/02.txt", "Jungle/Old/03.txt",
+				"Jungle/Old/Older/04.txt"}},
+		{"exclude directory by name", func(f *LevelFinder) {
+			f.Depth = -1
+			f.Exclude = []string{"Old"}
+		}, []string{"01.txt", "Desert/05.txt", "Desert/06.txt",
+			"Jungle/02.txt"}},
+		{"exclude directory by path", func(f *LevelFinder) {
+			f.Exclude = []string{"Desert"}
+		}, []string{"01.txt", "Jungle/02.txt"}},
+		{"exclude file by path", func(f *LevelFinder) {
+			f.Exclude = []string{"Desert/05.png"}
+		}, []string{"01.txt", "Desert/06.txt", "Jungle/02.txt"}},
+		{"include", func(f *LevelFinder) {
+			f.Depth = -1
+			f.Include = []string{"Jungle/*/*.png", "05.png"}
+		}, []string{"Desert/05.txt", "Jungle/Old/03.txt"}},
+		{"template", func(f *LevelFinder) {
+			f.OutputTemplate = template.Must(template.New("output").Parse(
+				`{{.Dir}}-{{printf "%03d" .Level}}-{{.Name}}.txt`))
+		}, []string{".-001-01.txt", "Desert-005-05.txt", "Desert-006-06.txt",
+			"Jungle-002-02.txt"}},
+		{"template outside output", func(f *LevelFinder) {
+			f.OutputTemplate = template.Must(template.New("output").Parse(
+				`../{{.Name}}.txt`))
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := t.TempDir()
+			f := NewLevelFinder(in, out)
+			f.Logf = func(format string, args ...any) {}
+			test.setup(f)
+			var found []string
+			f.Find(func(inPath, outPath string) bool {
+				rel, err := filepath.Rel(out, outPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				found = append(found, filepath.ToSlash(rel))
+				return true
+			})
+			if !reflect.DeepEqual(found, test.expected) {
+				t.Errorf("found %v, expected %v", found, test.expected)
+			}
+		})
+	}
+}
+
+func TestLevelFinderFindFile(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "07.png")
+	writeTestPNG(t, in, 0)
+	outDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := template.Must(template.New("output").Parse(
+		`{{.Dir}}/level{{.Level}}.txt`))
+	tests := []struct {
+		name, output, expected string
+	}{
+		{"text file", filepath.Join(dir, "map.txt"),
+			filepath.Join(dir, "map.txt")},
+		{"other extension", filepath.Join(dir, "map.png"),
+			filepath.Join(dir, "map.txt")},
+		{"short name", "m", "m.txt"},
+		{"folder", outDir, filepath.Join(outDir, "level7.txt")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewLevelFinder(in, test.output)
+			f.OutputTemplate = tmpl
+			f.Logf = func(format string, args ...any) {}
+			var found []string
+			f.Find(func(inPath, outPath string) bool {
+				found = append(found, outPath)
+				return true
+			})
+			expected := []string{test.expected}
+			if !reflect.DeepEqual(found, expected) {
+				t.Errorf("found %v, expected %v", found, expected)
+			}
+		})
+	}
+}
+
+func TestOutputFor(t *testing.T) {
+	f := NewLevelFinder("in", "out")
+	out, err := f.OutputFor("Jungle/Level 7.png", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join("out", "Jungle", "Level 7.txt"); out != expected {
+		t.Errorf("output is %s, expected %s", out, expected)
+	}
+	f.OutputTemplate = template.Must(template.New("output").Parse(
+		`{{.Dir}}/{{printf "%02d" .Level}}.txt`))
+	out, err = f.OutputFor("Jungle/Level 7.png", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join("out", "Jungle", "07.txt"); out != expected {
+		t.Errorf("output is %s, expected %s", out, expected)
+	}
+}
+
+func TestClassifyCountsPuzzles(t *testing.T) {
+	// A row of 5 tiles, of which the last isn't in the reference hashes
+	const n = 5
+	img := image.NewRGBA(image.Rect(0, 0,
+		n*edshot.MAP_TILE_WIDTH, edshot.MAP_TILE_HEIGHT))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i*7 + i/61)
+	}
+	grid := edshot.Grid{Bounds: img.Bounds(), Columns: n, Rows: 1}
+	refs := make(edshot.RefHashes)
+	for x := 0; x < n-1; x++ {
+		refs.Add("Blue", x, edshot.HashTile(grid.TileImage(img, x, 0)))
+	}
+	for _, unknownAsPuzzle := range []bool{false, true} {
+		cfg := &Config{RefTiles: refs, UnknownAsPuzzle: unknownAsPuzzle,
+			Classifier: edshot.NewHashClassifier(refs)}
+		// The selecter is outside the image, so the theme is detected from
+		// the hashes
+		j := &Job{In: "01.png", img: img, grid: grid, scale: 1,
+			selBounds: image.Rect(-300, 0, -100, 200)}
+		j.Classify(context.Background(), cfg)
+		if j.Failed {
+			t.Fatal(j.err)
+		}
+		expected := repton2.T_UNKNOWN
+		if unknownAsPuzzle {
+			expected = repton2.T_PUZZLE
+		}
+		if j.NPuzzles != 1 || j.NUnknown != 1 || j.m.At(n-1, 0) != expected {
+			t.Errorf("unknown-as-puzzle=%t: %d puzzle pieces, %d unknown, "+
+				"last tile %s", unknownAsPuzzle, j.NPuzzles, j.NUnknown,
+				repton2.TileName(j.m.At(n-1, 0)))
+		}
+	}
+}
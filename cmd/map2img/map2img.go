@@ -0,0 +1,123 @@
+// map2img does the opposite of img2map, drawing maps in the ASCII format as
+// PNGs. $1 is a folder of sprites in the layout read by sprites.LoadDir. The
+// input, $2, can be a single level's text file, a scenario folder containing
+// 01.txt ... 20.txt, or a scenario file made by mkscenario. $3 is the output,
+// which is a PNG for a single level, otherwise a folder which will be filled
+// with 01.png ... 20.png.
+//
+// By default the tiles are the same size as in the editor's map at the pixel
+// scale given by -scale, which defaults to 2 as on a hidpi screen; -size rrp
+// makes them the same size as the Repton Resource Page's maps instead.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/realh/repmap/pkg/render"
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+	"github.com/realh/repmap/pkg/sprites"
+)
+
+// RenderLevel draws a map and saves it as a PNG.
+func RenderLevel(m *repton2.Map, set sprites.Set, tw, th int,
+	outFilename string,
+) error {
+	warned := make(map[int]bool)
+	for _, t := range m.Tiles {
+		if !warned[t] && set.Get(m.Theme, t) == nil {
+			log.Printf("Warning: no %s sprite for %s in '%s'",
+				m.Theme, repton2.TileName(t), outFilename)
+			warned[t] = true
+		}
+	}
+	img, err := render.RenderMap(m, set, tw, th)
+	if err != nil {
+		return fmt.Errorf("Unable to render '%s': %v", outFilename, err)
+	}
+	return repton.SavePNG(img, outFilename)
+}
+
+// RenderLevels renders a scenario's worth of levels into folder outDir.
+func RenderLevels(levels []*repton2.Map, set sprites.Set, tw, th int,
+	outDir string,
+) error {
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("Unable to create output folder '%s': %v",
+			outDir, err)
+	}
+	for n, m := range levels {
+		err := RenderLevel(m, set, tw, th,
+			filepath.Join(outDir, fmt.Sprintf("%02d.png", n+1)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	size := flag.String("size", "editor",
+		"Size of tiles: editor or rrp (Repton Resource Page)")
+	scale := flag.Int("scale", 2,
+		"Pixel scale of the editor's map for -size editor, eg 2 for hidpi")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"Usage: map2img [options] sprites_folder input output")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var tw, th int
+	switch *size {
+	case "editor":
+		if *scale < 1 {
+			log.Fatalf("Invalid scale %d", *scale)
+		}
+		tw = render.EDITOR_TILE_WIDTH * *scale
+		th = render.EDITOR_TILE_HEIGHT * *scale
+	case "rrp":
+		tw, th = render.RRP_TILE_WIDTH, render.RRP_TILE_HEIGHT
+	default:
+		log.Fatalf("Invalid size '%s'", *size)
+	}
+	set, err := sprites.LoadDir(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to load sprites: %v", err)
+	}
+	input, output := flag.Arg(1), flag.Arg(2)
+	stat, err := os.Stat(input)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if stat.IsDir() {
+		levels, err := repton2.LoadLevelsDir(input)
+		if err == nil {
+			err = RenderLevels(levels, set, tw, th, output)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	m, err := repton2.LoadASCII(input)
+	if err == nil {
+		err = RenderLevel(m, set, tw, th, output)
+	} else if s, err2 := repton2.LoadBundle(input); err2 == nil {
+		levels := make([]*repton2.Map, repton2.N_LEVELS)
+		for n := range levels {
+			levels[n] = s.Levels[n].Map
+		}
+		err = RenderLevels(levels, set, tw, th, output)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
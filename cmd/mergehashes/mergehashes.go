@@ -0,0 +1,77 @@
+// mergehashes adds newly labelled tile hashes to a set of reference hashes.
+// $1 is the existing reference hashes (eg reftilehashes.json) and $2 is a
+// labels file, normally the labels.csv written by img2map -learn with the tile
+// names filled in. The merged reference hashes are written to stdout.
+//
+// Each line of the labels file is in the format Theme,hash,name where name is
+// a tile name as in pkg/repton2/tiles.go, with or without the T_ prefix. Lines
+// with no name, blank lines and lines starting with '#' are ignored. A tile
+// which already has a different hash for the theme keeps it, and the new hash
+// is added as another variant of the tile. A hash which was labelled as a
+// different tile before is moved to the new one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+
+	"github.com/realh/repmap/pkg/edshot"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+// Merge adds labels to refs, returning the number of hashes added. Hashes
+// which refs already has for the same tile aren't counted.
+func Merge(refs edshot.RefHashes, labels []edshot.Label) (added int) {
+	for _, l := range labels {
+		// A hash can only represent one tile
+		for t, hs := range refs[l.Theme] {
+			if t != l.Tile && slices.Contains(hs, l.Hash) {
+				log.Printf("%s hash %d moved from %s to %s", l.Theme, l.Hash,
+					repton2.TileName(t), repton2.TileName(l.Tile))
+				refs.Remove(l.Theme, t, l.Hash)
+			}
+		}
+		if refs.Add(l.Theme, l.Tile, l.Hash) {
+			added++
+		}
+	}
+	return
+}
+
+func main() {
+	v1 := flag.Bool("v1", false,
+		"Write the old (version 1) reference hashes format")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: mergehashes [options] "+
+			"reftilehashes.json labels.csv > new.json")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	refs, err := edshot.LoadRefHashes(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to load/parse reference tiles: %v", err)
+	}
+	labels, err := edshot.LoadLabels(flag.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to load labels: %v", err)
+	}
+	added := Merge(refs, labels)
+	if *v1 {
+		err = edshot.WriteRefHashesV1(os.Stdout, refs)
+	} else {
+		err = edshot.WriteRefHashes(os.Stdout, refs,
+			edshot.NewRefHashesHeader("mergehashes",
+				flag.Arg(0)+" + "+flag.Arg(1)))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Added %d hashes", added)
+}
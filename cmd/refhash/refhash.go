@@ -1,107 +1,459 @@
 // The refhash binary takes a folder containing editor screenshots of a dummy
 // level containing all possible sprites that may appear in a map.  There must
 // be one file for each of the colours used by Repton, called Blue.png ...
-// Red.png. The output on stdout is a JSON file containing hash values for all
-// the tiles.
+// Red.png. The output is a JSON file containing hash values for all the tiles,
+// written to the file given with -o, or stdout. If any screenshot or sprite
+// couldn't be processed, nothing is written and the exit status is 1; -o leaves
+// an existing file alone in that case, whereas redirecting stdout to it would
+// empty it. With -sprites the tiles are also saved as reference sprites for
+// img2map's fuzzy matching. The layout of the dummy level can be given in an
+// ASCII map file with -layout; it defaults to DEFAULT_LAYOUT.
+//
+// With -verify file, the new hashes are compared with an existing reference
+// hashes file instead of being written to stdout. Each difference, and any
+// collisions between different tiles in the new hashes, is listed on stdout,
+// and the exit status is 1 if there were any.
+//
+// Alternatively, with -from-sprites, the input folder is a set of labelled
+// sprites in any of the layouts read by sprites.LoadDir, eg a folder of
+// T_NAME.png files for each theme. Each sprite is hashed as if it appeared in
+// a screenshot (see edshot.HashSprite); sprites which aren't 16 x 15, or a
+// whole multiple of that, eg those from extractatlases, are resampled to
+// 16 x 15 first. Sprites smaller than that are reported and count as failures.
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
 	_ "image/png"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/realh/repmap/pkg/edshot"
 	"github.com/realh/repmap/pkg/repton"
 	"github.com/realh/repmap/pkg/repton2"
+	"github.com/realh/repmap/pkg/sprites"
 )
 
-// HashTileSet gets the hashes of a list of tile indices (corresponding to the
-// T_ constants), using the positions as used in the reference level snapshots.
-// bounds is the map region.
-func HashTileSet(img image.Image, bounds image.Rectangle) []uint32 {
+// DEFAULT_LAYOUT is the layout of the reference level used if -layout isn't
+// given. The editor only allows brick ground to appear in the top row of a
+// map, so this is at 0, 0, next to the red-background skull. The following
+// rows are a copy of the tile selecter, with blanks for puzzle and brick
+// ground. The theme is ignored.
+const DEFAULT_LAYOUT = `Blue
+WX......................
+.12345..................
+6789AB..................
+CDEFGH..................
+IJKLMN..................
+OPQRST..................
+.V......................
+........................
+`
+
+// LoadLayout loads the layout of the reference level from an ASCII map file,
+// or returns DEFAULT_LAYOUT if filename is empty.
+func LoadLayout(filename string) (*repton2.Map, error) {
+	if filename == "" {
+		return repton2.ReadASCII(strings.NewReader(DEFAULT_LAYOUT))
+	}
+	return repton2.LoadASCII(filename)
+}
+
+// RefTilePositions returns the position of each tile type (corresponding to
+// the T_ constants) in the reference level snapshots, ie the first cell where
+// it appears in layout. Tiles which don't appear, and puzzle pieces, have
+// negative coordinates.
+func RefTilePositions(layout *repton2.Map) []image.Point {
 	positions := make([]image.Point, repton2.N_TILES)
-	ch := make(chan bool, repton2.N_TILES)
 	for i := range positions {
-		go func(i int) {
-			var x, y int
-			// Editor only allows brick ground to appear in the top row of a
-			// map, so this is at 0, 0. The following rows are a copy of the
-			// tile selecter, with blanks for puzzle and brick ground.
-			// Red-background skull is next to brick ground at position (1, 0).
-			switch i {
-			case repton2.T_BRICK_GROUND:
-				x = 0
-				y = 0
-			case repton2.T_SKULL_RED:
-				x = 1
-				y = 0
-			case repton2.T_PUZZLE:
-				x = -1
-				y = -1
-			default:
-				x = i % edshot.SEL_COLUMNS
-				y = i/edshot.SEL_COLUMNS + 1
+		positions[i] = image.Point{-1, -1}
+	}
+	for y := layout.Height - 1; y >= 0; y-- {
+		for x := layout.Width - 1; x >= 0; x-- {
+			t := layout.At(x, y)
+			if t != repton2.T_UNKNOWN && t != repton2.T_PUZZLE {
+				positions[t] = image.Point{x, y}
 			}
-			positions[i] = image.Point{x, y}
-			ch <- true
-		}(i)
+		}
 	}
-	// await
-	for range positions {
-		<-ch
+	return positions
+}
+
+// CheckLayout checks that a screenshot of the reference level matches layout.
+// Every cell of a tile type must look the same, and different tile types must
+// look different. Cells containing puzzle pieces or unknown tiles ('?') aren't
+// checked. It returns a description of each problem found.
+func CheckLayout(img image.Image, grid edshot.Grid, layout *repton2.Map,
+) []string {
+	if grid.Columns < layout.Width || grid.Rows < layout.Height {
+		return []string{fmt.Sprintf("map is %d x %d but layout is %d x %d",
+			grid.Columns, grid.Rows, layout.Width, layout.Height)}
+	}
+	positions := make([]image.Point, 0, layout.Width*layout.Height)
+	for y := 0; y < layout.Height; y++ {
+		for x := 0; x < layout.Width; x++ {
+			positions = append(positions, image.Point{x, y})
+		}
 	}
-	return edshot.HashMapTiles(img, bounds, positions)
+	hashes := edshot.HashMapTiles(img, grid, positions)
+	var problems []string
+	first := make(map[int]image.Point)
+	tileOfHash := make(map[uint32]int)
+	for i, point := range positions {
+		t := layout.At(point.X, point.Y)
+		if t == repton2.T_UNKNOWN || t == repton2.T_PUZZLE {
+			continue
+		}
+		if p, ok := first[t]; !ok {
+			first[t] = point
+			if t2, ok := tileOfHash[hashes[i]]; ok {
+				problems = append(problems, fmt.Sprintf(
+					"%s at %d,%d looks the same as %s at %d,%d",
+					repton2.TileName(t), point.X, point.Y,
+					repton2.TileName(t2), first[t2].X, first[t2].Y))
+			} else {
+				tileOfHash[hashes[i]] = t
+			}
+		} else if hashes[i] != hashes[p.Y*layout.Width+p.X] {
+			problems = append(problems, fmt.Sprintf(
+				"%s at %d,%d doesn't look the same as at %d,%d",
+				repton2.TileName(t), point.X, point.Y, p.X, p.Y))
+		}
+	}
+	return problems
 }
 
-// ProcessEditorShot finds the map region in the named PNG and returns hashes of
-// the tiles in it. If first is true it processes all the tiles, otherwise only
-// the ones that depend on the colour theme.
-func ProcessEditorShot(filename string) []uint32 {
-	img, mapBounds, _, err := edshot.LoadMap(filename)
+// HashTileSet gets the hashes of a list of tile indices (corresponding to the
+// T_ constants), using the positions of the tiles in layout. grid is the map's
+// tiles.
+func HashTileSet(img image.Image, grid edshot.Grid, layout *repton2.Map,
+) []uint32 {
+	return edshot.HashMapTiles(img, grid, RefTilePositions(layout))
+}
+
+// ExtractTileSet is like HashTileSet but returns the tiles' images at their
+// nominal size instead of hashes.
+func ExtractTileSet(img image.Image, grid edshot.Grid, layout *repton2.Map,
+) []image.Image {
+	sprites := make([]image.Image, repton2.N_TILES)
+	for i, point := range RefTilePositions(layout) {
+		if point.X >= 0 && point.Y >= 0 {
+			sprites[i] = grid.ExtractTile(img, point.X, point.Y)
+		}
+	}
+	return sprites
+}
+
+// ProcessEditorShot finds the map region in the named PNG, checks it against
+// layout, and returns hashes of the tiles in it. If withSprites is true it
+// also returns the tiles' images. If the screenshot couldn't be loaded or
+// doesn't match the layout, the result is nil and the problems are logged.
+func ProcessEditorShot(filename string, layout *repton2.Map, withSprites bool,
+) ([]uint32, []image.Image) {
+	img, grid, _, _, err := edshot.LoadMap(filename, nil)
 	if err != nil {
 		log.Println(err)
-		return nil
+		return nil, nil
+	}
+	if problems := CheckLayout(img, grid, layout); len(problems) != 0 {
+		for _, p := range problems {
+			log.Printf("%s doesn't match layout: %s", filename, p)
+		}
+		return nil, nil
+	}
+	var sprites []image.Image
+	if withSprites {
+		sprites = ExtractTileSet(img, grid, layout)
 	}
-	return HashTileSet(img, mapBounds)
+	return HashTileSet(img, grid, layout), sprites
 }
 
-func ArrayOfUint32ToString(a []uint32) string {
-	s := make([]string, len(a))
-	for i, v := range a {
-		s[i] = fmt.Sprintf("%d", v)
+// HashSpriteSet gets the hashes of a theme's sprites, indexed by the T_
+// constants. As with HashTileSet, puzzle pieces and missing sprites have a hash
+// of 0, as do sprites which can't be hashed; these are logged and failed is
+// true.
+func HashSpriteSet(theme string, sprts []image.Image,
+) (hashes []uint32, failed bool) {
+	hashes = make([]uint32, repton2.N_TILES)
+	for t, sprt := range sprts {
+		if sprt == nil || t == repton2.T_PUZZLE {
+			continue
+		}
+		h, err := edshot.HashSprite(sprt)
+		if err != nil {
+			log.Printf("Can't hash %s sprite for %s: %v", theme,
+				repton2.TileName(t), err)
+			failed = true
+		}
+		hashes[t] = h
 	}
-	return strings.Join(s, ", ")
+	return
 }
 
-func main() {
+// Difference describes a way in which freshly computed reference hashes differ
+// from existing ones, or a problem with them. Tile is -1 if the difference
+// applies to the whole theme.
+type Difference struct {
+	Theme  string
+	Tile   int
+	Status string
+	Detail string
+}
+
+// Statuses of Differences
+const (
+	DIFF_CHANGED   = "changed"   // Tile's hash is different
+	DIFF_MISSING   = "missing"   // Tile or theme has no hash any more
+	DIFF_ADDED     = "added"     // Tile or theme didn't have a hash before
+	DIFF_COLLISION = "collision" // Two different tiles have the same hash
+)
+
+func (d Difference) String() string {
+	tile := "*"
+	if d.Tile >= 0 {
+		tile = repton2.TileName(d.Tile)
+	}
+	return fmt.Sprintf("%s %s %s: %s", d.Theme, tile, d.Status, d.Detail)
+}
+
+// CompareRefHashes compares newly computed hashes, refs, with old ones and
+// returns the differences in order of theme and tile. A theme with no hashes
+// is treated the same as a missing theme. The old hashes may have several
+// variants of a tile, eg added by mergehashes; a tile only differs if one of
+// its new hashes isn't among the old ones, or it has no new hashes.
+func CompareRefHashes(old, refs edshot.RefHashes) []Difference {
+	var diffs []Difference
+	for _, clr := range repton.ColourNames {
+		oldHashes, hashes := old[clr], refs[clr]
+		hadOld, hasNew := hasHashes(oldHashes), hasHashes(hashes)
+		if hadOld && !hasNew {
+			diffs = append(diffs, Difference{clr, -1, DIFF_MISSING,
+				"theme not in new hashes"})
+			continue
+		} else if hasNew && !hadOld {
+			diffs = append(diffs, Difference{clr, -1, DIFF_ADDED,
+				"theme not in old hashes"})
+			continue
+		}
+		for t := 0; t < len(oldHashes) || t < len(hashes); t++ {
+			var o, h []uint32
+			if t < len(oldHashes) {
+				o = oldHashes[t]
+			}
+			if t < len(hashes) {
+				h = hashes[t]
+			}
+			switch {
+			case len(o) == 0 && len(h) == 0:
+			case len(h) == 0:
+				diffs = append(diffs, Difference{clr, t, DIFF_MISSING,
+					fmt.Sprintf("was %s", formatHashes(o))})
+			case len(o) == 0:
+				diffs = append(diffs, Difference{clr, t, DIFF_ADDED,
+					fmt.Sprintf("now %s", formatHashes(h))})
+			default:
+				for _, hash := range h {
+					if !slices.Contains(o, hash) {
+						diffs = append(diffs, Difference{clr, t, DIFF_CHANGED,
+							fmt.Sprintf("%s -> %s", formatHashes(o),
+								formatHashes(h))})
+						break
+					}
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+// hasHashes returns true if any of a theme's tiles has a hash.
+func hasHashes(tiles [][]uint32) bool {
+	for _, hs := range tiles {
+		if len(hs) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// formatHashes formats a tile's hashes for a Difference's Detail.
+func formatHashes(hashes []uint32) string {
+	s := make([]string, len(hashes))
+	for i, h := range hashes {
+		s[i] = fmt.Sprintf("%d", h)
+	}
+	return strings.Join(s, "/")
+}
+
+// FindCollisions looks for hashes in refs which belong to more than one tile,
+// either in the same theme or different themes. The same tile may have the
+// same hash in different themes, because some tiles look the same in every
+// theme.
+func FindCollisions(refs edshot.RefHashes) []Difference {
+	type owner struct {
+		theme string
+		tile  int
+	}
+	var diffs []Difference
+	owners := make(map[uint32]owner)
+	for _, clr := range repton.ColourNames {
+		for t, hs := range refs[clr] {
+			for _, h := range hs {
+				if o, ok := owners[h]; !ok {
+					owners[h] = owner{clr, t}
+				} else if o.tile != t {
+					diffs = append(diffs, Difference{clr, t, DIFF_COLLISION,
+						fmt.Sprintf("hash %d is also %s %s", h, o.theme,
+							repton2.TileName(o.tile))})
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+// HashScreenshots hashes the tiles in the screenshots of the reference level
+// for each theme in folder. If spritesDir isn't empty the tiles are saved
+// there as sprites. If any theme's screenshot couldn't be processed, failed is
+// true.
+func HashScreenshots(folder string, layout *repton2.Map, spritesDir string,
+) (refs edshot.RefHashes, failed bool) {
 	n := len(repton.ColourNames)
 	// ch is for awaiting completed goroutines
 	ch := make(chan bool, n)
-	themedSets := make([]string, n)
-	for i, clr := range repton.ColourNames {
-		go func(i int, clr string) {
-			ct := ProcessEditorShot(
-				filepath.Join(os.Args[1], clr+".png"))
-			themedSets[i] = ArrayOfUint32ToString(ct)
+	refs = make(edshot.RefHashes)
+	spriteSet := make(sprites.Set)
+	var lock sync.Mutex
+	for _, clr := range repton.ColourNames {
+		go func(clr string) {
+			filename := filepath.Join(folder, clr+".png")
+			ct, sprts := ProcessEditorShot(filename, layout, spritesDir != "")
+			lock.Lock()
+			if ct != nil {
+				refs.SetTheme(clr, ct)
+			} else if clr != repton.ColourNames[repton.KC_BLACK] {
+				failed = true
+			}
+			if sprts != nil {
+				spriteSet[clr] = sprts
+			}
+			lock.Unlock()
 			ch <- true
-		}(i, clr)
+		}(clr)
 	}
 	for range repton.ColourNames {
 		<-ch
 	}
-	fmt.Println("{")
-	for i, clr := range repton.ColourNames {
-		fmt.Printf(`  "%s": [`, clr)
-		fmt.Print(themedSets[i])
-		if i < n-1 {
-			fmt.Println("],")
+	if spritesDir != "" {
+		if err := spriteSet.SaveDir(spritesDir); err != nil {
+			log.Fatalf("Failed to save sprites: %v", err)
+		}
+	}
+	return
+}
+
+// HashSpritesDir hashes the sprites in folder, which is laid out as for
+// sprites.LoadDir. If any sprites couldn't be hashed, failed is true.
+func HashSpritesDir(folder string) (refs edshot.RefHashes, failed bool) {
+	set, err := sprites.LoadDir(folder)
+	if err != nil {
+		log.Fatalf("Failed to load sprites: %v", err)
+	}
+	refs = make(edshot.RefHashes)
+	for theme, sprts := range set {
+		hashes, f := HashSpriteSet(theme, sprts)
+		refs.SetTheme(theme, hashes)
+		failed = failed || f
+		for _, t := range set.Missing(theme) {
+			if t != repton2.T_PUZZLE {
+				log.Printf("%s has no sprite for %s", theme,
+					repton2.TileName(t))
+			}
+		}
+	}
+	return
+}
+
+func main() {
+	spritesDir := flag.String("sprites", "",
+		"Also save the reference tiles as sprites in this folder")
+	fromSprites := flag.Bool("from-sprites", false,
+		"input_folder contains sprites instead of screenshots")
+	layoutFile := flag.String("layout", "",
+		"ASCII map file giving the layout of the reference level")
+	verify := flag.String("verify", "",
+		"Compare with this reference hashes file instead of writing JSON")
+	v1 := flag.Bool("v1", false,
+		"Write the old (version 1) reference hashes format")
+	output := flag.String("o", "",
+		"Write the JSON to this file instead of stdout, replacing it only "+
+			"if successful")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"Usage: refhash [options] -o reftilehashes.json input_folder")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var refs edshot.RefHashes
+	failed := false
+	if *fromSprites {
+		if *spritesDir != "" {
+			log.Fatalln("-sprites can't be used with -from-sprites")
+		}
+		refs, failed = HashSpritesDir(flag.Arg(0))
+	} else {
+		layout, err := LoadLayout(*layoutFile)
+		if err != nil {
+			log.Fatalf("Failed to load layout: %v", err)
+		}
+		refs, failed = HashScreenshots(flag.Arg(0), layout, *spritesDir)
+	}
+	if *verify != "" {
+		old, err := edshot.LoadRefHashes(*verify)
+		if err != nil {
+			log.Fatalf("Failed to load/parse reference tiles: %v", err)
+		}
+		diffs := CompareRefHashes(old, refs)
+		diffs = append(diffs, FindCollisions(refs)...)
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+		if len(diffs) != 0 {
+			log.Printf("%d differences from %s", len(diffs), *verify)
+			failed = true
+		}
+	} else if failed {
+		log.Println("Not writing reference hashes because of the errors above")
+	} else {
+		write := func(w io.Writer) error {
+			if *v1 {
+				return edshot.WriteRefHashesV1(w, refs)
+			}
+			return edshot.WriteRefHashes(w, refs,
+				edshot.NewRefHashesHeader("refhash", flag.Arg(0)))
+		}
+		var err error
+		if *output != "" {
+			err = repton.WriteFileAtomic(*output, write)
 		} else {
-			fmt.Println("]")
+			err = write(os.Stdout)
 		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if failed {
+		os.Exit(1)
 	}
-	fmt.Println("}")
 }
@@ -0,0 +1,25 @@
+// unpackscenario does the opposite of mkscenario. It takes a combined scenario
+// file ($1) and unpacks it into a folder ($2) containing 01.txt ... 20.txt,
+// Borders.csv, Transporters.csv and Puzzle.csv. The folder is created if
+// necessary.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		log.Fatalln("unpackscenario takes 2 arguments: input file, output folder")
+	}
+	s, err := repton2.LoadBundle(os.Args[1])
+	if err != nil {
+		log.Fatalf("Unable to load scenario: %v", err)
+	}
+	if err = s.SaveScenarioDir(os.Args[2]); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/realh/repmap
 
 go 1.21
 
-require github.com/crazy3lf/colorconv v1.2.0 // indirect
+require github.com/crazy3lf/colorconv v1.2.0
@@ -56,7 +56,7 @@ func ComposeAtlas(tiles []image.Image) image.Image {
     aw := tw * columns
     ah := th * rows
     fmt.Printf("Atlas size in pixels %d x %d\n", aw, ah)
-    atlas := image.NewRGBA(image.Rect(0, aw, 0, ah))
+    atlas := image.NewRGBA(image.Rect(0, 0, aw, ah))
     for i, tile := range tiles {
         col := i % columns
         row := i / columns
@@ -0,0 +1,202 @@
+package edshot
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+// Methods by which a tile may be classified
+const (
+	METHOD_HASH    = "hash"    // Exact match of HashImage
+	METHOD_FUZZY   = "fuzzy"   // FuzzyMatch
+	METHOD_NEAREST = "nearest" // NearestClassifier
+	METHOD_NONE    = "none"    // Not recognised
+)
+
+// Classification is the result of working out what a tile is. Tile is
+// repton2.T_UNKNOWN if it wasn't recognised. Confidence is between 0 and 1:
+// 1 for an exact match, 1 - distance for a fuzzy match and 0 for an
+// unrecognised tile.
+type Classification struct {
+	Tile       int
+	Method     string
+	Confidence float64
+}
+
+// Unknown is the Classification of an unrecognised tile.
+var Unknown = Classification{repton2.T_UNKNOWN, METHOD_NONE, 0}
+
+// TileClassifier works out which tile occupies region r of img in a map with
+// the given colour theme (eg "Blue"). r is either MAP_TILE_WIDTH x
+// MAP_TILE_HEIGHT or a whole multiple of that; see Grid.TileImage. If the tile
+// isn't recognised the result is Unknown. Classify may be called from several
+// goroutines at once.
+type TileClassifier interface {
+	Classify(img image.Image, r image.Rectangle, theme string) Classification
+}
+
+// HashedClassifier is a TileClassifier which can classify a tile from its
+// hash, as calculated by HashTile, so that tiles which have already been
+// hashed, eg for DetectTheme, needn't be hashed again. See ClassifyHashed.
+type HashedClassifier interface {
+	TileClassifier
+	ClassifyHash(hash uint32, theme string) Classification
+}
+
+// ClassifyHashed is like c.Classify for a tile whose hash has already been
+// calculated by HashTile. If c is a HashedClassifier it's given the hash
+// instead of the tile, and if it's a ChainClassifier the hash is passed on to
+// each of its classifiers in the same way.
+func ClassifyHashed(c TileClassifier, img image.Image, r image.Rectangle,
+	hash uint32, theme string,
+) Classification {
+	switch c := c.(type) {
+	case HashedClassifier:
+		return c.ClassifyHash(hash, theme)
+	case ChainClassifier:
+		return c.ClassifyWithHash(img, r, hash, theme)
+	}
+	return c.Classify(img, r, theme)
+}
+
+// HashClassifier recognises tiles whose hashes (see HashTile) exactly match
+// reference hashes. It's a HashedClassifier.
+type HashClassifier struct {
+	tiles map[string]map[uint32]int
+}
+
+// NewHashClassifier creates a HashClassifier from reference hashes as loaded
+// by LoadRefHashes. A tile matches any of its hashes.
+func NewHashClassifier(refs RefHashes) *HashClassifier {
+	c := &HashClassifier{make(map[string]map[uint32]int)}
+	for theme, hashes := range refs {
+		tiles := make(map[uint32]int)
+		for t, hs := range hashes {
+			for _, h := range hs {
+				tiles[h] = t
+			}
+		}
+		c.tiles[theme] = tiles
+	}
+	return c
+}
+
+func (c *HashClassifier) Classify(img image.Image, r image.Rectangle,
+	theme string,
+) Classification {
+	return c.ClassifyHash(HashTile(img, r), theme)
+}
+
+// ClassifyHash is like Classify for a tile whose hash has already been
+// calculated.
+func (c *HashClassifier) ClassifyHash(hash uint32, theme string,
+) Classification {
+	if t, ok := c.tiles[theme][hash]; ok {
+		return Classification{t, METHOD_HASH, 1}
+	}
+	return Unknown
+}
+
+// ChainClassifier tries each of its classifiers in turn, returning the first
+// result which isn't Unknown.
+type ChainClassifier []TileClassifier
+
+func (c ChainClassifier) Classify(img image.Image, r image.Rectangle,
+	theme string,
+) Classification {
+	for _, classifier := range c {
+		result := classifier.Classify(img, r, theme)
+		if result.Tile != repton2.T_UNKNOWN {
+			return result
+		}
+	}
+	return Unknown
+}
+
+// ClassifyWithHash is like Classify for a tile whose hash has already been
+// calculated; see ClassifyHashed.
+func (c ChainClassifier) ClassifyWithHash(img image.Image, r image.Rectangle,
+	hash uint32, theme string,
+) Classification {
+	for _, classifier := range c {
+		result := ClassifyHashed(classifier, img, r, hash, theme)
+		if result.Tile != repton2.T_UNKNOWN {
+			return result
+		}
+	}
+	return Unknown
+}
+
+// MapClassification is the result of ClassifyMap. Hashes and Tiles are the
+// hashes and classifications of the map's tiles, row by row like
+// repton2.Map.Tiles.
+type MapClassification struct {
+	Theme  ThemeDetection
+	Width  int
+	Height int
+	Hashes []uint32
+	Tiles  []Classification
+}
+
+// ClassifyMap works out what each tile of a map represents, given grid,
+// selBounds and scale as found by LocateMap. The tiles are hashed once, then
+// the map's theme is detected by DetectTheme using refs, and each tile is
+// classified by classifier with ClassifyHashed, sharing the work with
+// repton.ForEachParallel. Each tile's classification is recorded in trace. An
+// error is returned if the theme can't be detected; name is used in its
+// message, normally the screenshot's filename.
+func ClassifyMap(img image.Image, name string, grid Grid,
+	selBounds image.Rectangle, scale Scale, refs RefHashes,
+	classifier TileClassifier, trace *Trace,
+) (*MapClassification, error) {
+	w, h := grid.Columns, grid.Rows
+	mc := &MapClassification{Width: w, Height: h, Hashes: HashGrid(img, grid)}
+	mc.Theme = DetectTheme(img, selBounds, scale, mc.Hashes, refs, trace)
+	if mc.Theme.Theme == -1 {
+		return nil, fmt.Errorf("Failed to detect colour theme of '%s'", name)
+	}
+	theme := mc.ThemeName()
+	mc.Tiles = make([]Classification, len(mc.Hashes))
+	repton.ForEachParallel(len(mc.Tiles), func(i int) {
+		tile, r := grid.TileImage(img, i%w, i/w)
+		mc.Tiles[i] = ClassifyHashed(classifier, tile, r, mc.Hashes[i], theme)
+	})
+	for i, c := range mc.Tiles {
+		trace.AddTile(grid.TileRect(i%w, i/w), c.Method)
+	}
+	return mc, nil
+}
+
+// ConvertMap finds the map in a screenshot with LocateMap and classifies its
+// tiles with ClassifyMap.
+func ConvertMap(img image.Image, name string, refs RefHashes,
+	classifier TileClassifier, trace *Trace,
+) (*MapClassification, error) {
+	grid, selBounds, scale, err := LocateMap(img, name, trace)
+	if err != nil {
+		return nil, err
+	}
+	return ClassifyMap(img, name, grid, selBounds, scale, refs, classifier,
+		trace)
+}
+
+// ThemeName returns the name of the map's colour theme, eg "Blue".
+func (mc *MapClassification) ThemeName() string {
+	return repton.ColourNames[mc.Theme.Theme]
+}
+
+// Map returns the classified tiles as a repton2.Map. Unrecognised tiles are
+// T_UNKNOWN, or T_PUZZLE if unknownAsPuzzle is set.
+func (mc *MapClassification) Map(unknownAsPuzzle bool) *repton2.Map {
+	m := repton2.NewMap(mc.ThemeName(), mc.Width, mc.Height)
+	for i, c := range mc.Tiles {
+		m.Tiles[i] = c.Tile
+		if c.Tile == repton2.T_UNKNOWN && unknownAsPuzzle {
+			m.Tiles[i] = repton2.T_PUZZLE
+		}
+	}
+	return m
+}
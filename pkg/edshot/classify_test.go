@@ -0,0 +1,158 @@
+package edshot
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+// countingClassifier counts its calls and always returns result.
+type countingClassifier struct {
+	calls  int
+	result Classification
+}
+
+func (c *countingClassifier) Classify(img image.Image, r image.Rectangle,
+	theme string,
+) Classification {
+	c.calls++
+	return c.result
+}
+
+func TestClassifyHashed(t *testing.T) {
+	refs := make(RefHashes)
+	refs.Add("Blue", repton2.T_ROCK, 1234)
+	exact := NewHashClassifier(refs)
+	fallback := &countingClassifier{
+		result: Classification{repton2.T_DIAMOND, METHOD_FUZZY, 0.9}}
+	chain := ChainClassifier{exact, fallback}
+	// The tile's pixels don't hash to 1234, so this only works if the hash
+	// is used instead
+	tile := image.NewRGBA(image.Rect(0, 0, MAP_TILE_WIDTH, MAP_TILE_HEIGHT))
+	c := ClassifyHashed(chain, tile, tile.Bounds(), 1234, "Blue")
+	if c.Tile != repton2.T_ROCK || c.Method != METHOD_HASH {
+		t.Errorf("classified as %+v, expected a hash match for ROCK", c)
+	}
+	if fallback.calls != 0 {
+		t.Errorf("fallback was called after a hash match")
+	}
+	c = ClassifyHashed(chain, tile, tile.Bounds(), 5678, "Blue")
+	if c != fallback.result || fallback.calls != 1 {
+		t.Errorf("classified as %+v after %d fallback calls", c,
+			fallback.calls)
+	}
+	// Nested chains pass the hash on too
+	c = ClassifyHashed(ChainClassifier{chain}, tile, tile.Bounds(), 1234,
+		"Blue")
+	if c.Tile != repton2.T_ROCK {
+		t.Errorf("nested chain classified as %+v", c)
+	}
+}
+
+func TestConvertMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	puzzles := []image.Point{{3, 4}, {10, 0}}
+	set := testSprites(rng)
+	m := testMap(rng, "Green", 24, 20, puzzles)
+	refs := spriteHashes(set)
+	tests := []struct {
+		name        string
+		scale       int
+		colour      color.Color
+		themeMethod string
+	}{
+		{"1x", 1, color.RGBA{0, 255, 0, 255}, THEME_PIXEL},
+		{"2x", 2, color.RGBA{0, 255, 0, 255}, THEME_PIXEL},
+		{"theme by hashes", 2, testGrey, THEME_HASHES},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := fakeScreenshot(m, set["Green"], test.colour, test.scale)
+			trace := &Trace{}
+			mc, err := ConvertMap(img, test.name, refs,
+				ChainClassifier{NewHashClassifier(refs)}, trace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mc.ThemeName() != "Green" || mc.Theme.Method != test.themeMethod {
+				t.Errorf("theme is %s by %s", mc.ThemeName(), mc.Theme.Method)
+			}
+			if mc.Width != m.Width || mc.Height != m.Height {
+				t.Fatalf("map is %d x %d, expected %d x %d", mc.Width,
+					mc.Height, m.Width, m.Height)
+			}
+			if len(trace.Tiles) != len(m.Tiles) {
+				t.Errorf("%d tiles were traced", len(trace.Tiles))
+			}
+			for i, c := range mc.Tiles {
+				expected := m.Tiles[i]
+				if expected == repton2.T_PUZZLE {
+					expected = repton2.T_UNKNOWN
+				}
+				if c.Tile != expected {
+					t.Errorf("tile %d is %s, expected %s", i,
+						repton2.TileName(c.Tile), repton2.TileName(expected))
+				}
+			}
+			converted := mc.Map(true)
+			if !reflect.DeepEqual(converted, m) {
+				t.Errorf("converted map differs")
+			}
+		})
+	}
+}
+
+// themeColours are pure versions of repton.ColourNames, as seen in the
+// selecter of a map with each theme.
+var themeColours = []color.Color{
+	color.RGBA{0, 0, 255, 255},
+	color.RGBA{0, 255, 255, 255},
+	color.RGBA{0, 255, 0, 255},
+	color.RGBA{255, 0, 255, 255},
+	color.RGBA{255, 160, 0, 255},
+	color.RGBA{255, 0, 0, 255},
+}
+
+// BenchmarkConvertScenario converts 2x screenshots of all the levels of a
+// scenario, from PNG to repton2.Map, like img2map.
+func BenchmarkConvertScenario(b *testing.B) {
+	rng := rand.New(rand.NewSource(3))
+	set := testSprites(rng)
+	refs := spriteHashes(set)
+	classifier := ChainClassifier{NewHashClassifier(refs)}
+	var pngs [repton2.N_LEVELS][]byte
+	for n := range pngs {
+		theme := n % len(themeColours)
+		name := repton.ColourNames[theme]
+		m := testMap(rng, name, 32, 32, []image.Point{{n, n}})
+		img := fakeScreenshot(m, set[name], themeColours[theme], 2)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			b.Fatal(err)
+		}
+		pngs[n] = buf.Bytes()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n, data := range pngs {
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+			name := fmt.Sprintf("level %d", n+1)
+			mc, err := ConvertMap(img, name, refs, classifier, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			mc.Map(true)
+		}
+	}
+}
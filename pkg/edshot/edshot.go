@@ -5,40 +5,39 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"log"
+	"strings"
 
 	"github.com/realh/repmap/pkg/repton"
 )
 
+// Sizes of things in the editor at its normal size. Screenshots may be scaled
+// up, eg by 2 on hidpi screens; see DetectPixelScale.
 const (
-    PIXEL_SCALE            = 2      // For hidpi
-	SEL_TILE_WIDTH         = 32 * PIXEL_SCALE
-	SEL_TILE_HEIGHT        = 32 * PIXEL_SCALE
-	SEL_TILE_BORDER        = PIXEL_SCALE
+	SEL_TILE_WIDTH         = 32
+	SEL_TILE_HEIGHT        = 32
+	SEL_TILE_BORDER        = 1
 	PADDED_SEL_TILE_WIDTH  = SEL_TILE_WIDTH + 2*SEL_TILE_BORDER
 	PADDED_SEL_TILE_HEIGHT = SEL_TILE_HEIGHT + 2*SEL_TILE_BORDER
 	SEL_COLUMNS            = 6
 	SEL_ROWS               = 6
-	MAP_TILE_WIDTH         = 16 * PIXEL_SCALE
-	MAP_TILE_HEIGHT        = 15 * PIXEL_SCALE
+	MAP_TILE_WIDTH         = 16
+	MAP_TILE_HEIGHT        = 15
+	MAX_PIXEL_SCALE        = 4
 )
 
-// FindSelecters finds the extremities of the tile selecter area and also
-// returns the colour of the window background. This is fairly easy because the
-// region has a 1px black border. Each value in rect is the coordinate that the
-// border falls on.
-func FindSelecters(img image.Image) (rect image.Rectangle,
-	grey color.Color, err error,
-) {
-	bounds := img.Bounds()
-	// First look for the right border halfway down the window
-	y := (bounds.Max.Y - bounds.Min.Y) / 2
-	black := color.RGBA{0, 0, 0, 255}
-	var x int
+var black = color.RGBA{0, 0, 0, 255}
+
+// WINDOW_BORDER is the width of the editor window's frame at normal size,
+// which is skipped when looking for the selecter area.
+const WINDOW_BORDER = 16
+
+// findSelecterRight looks for the right border of the tile selecter area by
+// scanning left along row y from x0 in steps of step pixels. It also returns
+// the colour of the window background.
+func findSelecterRight(img image.Image, x0, y, step int,
+) (x int, grey color.Color, ok bool) {
 	// MAP_TILE_WIDTH * 8 is < minimum space needed to display actual map.
-	// 16 allows for window border.
-	for x = bounds.Max.X - 16 * PIXEL_SCALE; x > MAP_TILE_WIDTH*8;
-        x -= PIXEL_SCALE {
+	for x = x0; x > MAP_TILE_WIDTH*8*step; x -= step {
 		px := img.At(x, y)
 		if repton.ColourMatch(px, black) < repton.GOOD_MATCH {
 			break
@@ -46,53 +45,181 @@ func FindSelecters(img image.Image) (rect image.Rectangle,
 			grey = px
 		}
 	}
-	if x <= SEL_TILE_WIDTH*8 {
+	return x, grey, x > SEL_TILE_WIDTH*8*step
+}
+
+// verifyBlackEdge is like repton.VerifyBlackEdge, but if scale is fractional
+// the edge may be a pixel either side of (x, y) in the direction of (dx, dy)
+// due to rounding. It returns where the edge was found.
+func verifyBlackEdge(img image.Image, x, y, dx, dy int, scale Scale,
+	grey color.Color,
+) (int, int, bool) {
+	offsets := []int{0}
+	if !scale.IsInt() {
+		offsets = append(offsets, -1, 1)
+	}
+	ux, uy := min(max(dx, -1), 1), min(max(dy, -1), 1)
+	for _, o := range offsets {
+		ex, ey := x+o*ux, y+o*uy
+		if repton.VerifyBlackEdge(img, ex, ey, dx, dy, black, grey) {
+			return ex, ey, true
+		}
+	}
+	return x, y, false
+}
+
+// DetectPixelScale works out how many screenshot pixels correspond to each
+// pixel of the editor at its normal size, eg 2 for hidpi. This is based on
+// the height of the selecter area's right border, which is recorded in trace.
+// The result is rounded to a whole number if it's within a pixel per normal
+// pixel of one, otherwise it's fractional.
+//
+// The width of the window's frame depends on the scale too, so the search
+// for the border starts WINDOW_BORDER pixels from the right at scale 1, then
+// 2 etc up to MAX_PIXEL_SCALE. A result is only accepted if it's no more than
+// the scale the search assumed, otherwise the frame may have been mistaken for
+// the border.
+func DetectPixelScale(img image.Image, trace *Trace) (Scale, error) {
+	var err error
+	for s := 1; s <= MAX_PIXEL_SCALE; s++ {
+		var scale Scale
+		scale, err = detectPixelScaleFrom(img,
+			img.Bounds().Max.X-WINDOW_BORDER*s, trace)
+		if err == nil {
+			if scale <= Scale(s) {
+				return scale, nil
+			}
+			err = fmt.Errorf("Selecter region suggests scale %g, which "+
+				"doesn't fit the window frame", scale)
+		}
+	}
+	return 0, err
+}
+
+// detectPixelScaleFrom is the part of DetectPixelScale which searches for the
+// border from x0.
+func detectPixelScaleFrom(img image.Image, x0 int, trace *Trace,
+) (Scale, error) {
+	bounds := img.Bounds()
+	y := (bounds.Max.Y - bounds.Min.Y) / 2
+	x, grey, ok := findSelecterRight(img, x0, y, 1)
+	if !ok {
+		trace.addScanLine(x0, y, x, y, false)
+		return 0, fmt.Errorf("Right edge of selecter region not found")
+	}
+	isBlack := func(y int) bool {
+		return repton.ColourMatch(img.At(x, y), black) < repton.GOOD_MATCH
+	}
+	top := y
+	for top > bounds.Min.Y && isBlack(top-1) {
+		top--
+	}
+	bottom := y
+	for bottom < bounds.Max.Y-1 && isBlack(bottom+1) {
+		bottom++
+	}
+	height := bottom - top + 1
+	nominal := PADDED_SEL_TILE_HEIGHT * SEL_ROWS
+	scale := Scale(height) / Scale(nominal)
+	if n := (height + nominal/2) / nominal; n >= 1 &&
+		height >= n*nominal-n && height <= n*nominal+n {
+		scale = Scale(n)
+	}
+	if scale < 1 || scale > MAX_PIXEL_SCALE {
+		trace.addScanLine(x, top, x, bottom, false)
+		return 0, fmt.Errorf(
+			"Selecter region is %d pixels high, which isn't a valid scale", height)
+	}
+	// A dark line in the window frame may look like the right border, but it
+	// won't have a left border the right distance away
+	left := x - scale.Px(PADDED_SEL_TILE_WIDTH*SEL_COLUMNS-SEL_TILE_BORDER)
+	if _, _, ok := verifyBlackEdge(img, left, y, -scale.Step(), 0, scale,
+		grey); !ok {
+		trace.addScanLine(x, top, x, bottom, false)
+		trace.addScanLine(left, y, x, y, false)
+		return 0, fmt.Errorf("Selecter region %d pixels high has no left edge",
+			height)
+	}
+	trace.addScanLine(x, top, x, bottom, true)
+	return scale, nil
+}
+
+// FindSelecters finds the extremities of the tile selecter area and also
+// returns the colour of the window background. This is fairly easy because the
+// region has a 1px black border, scaled by scale. Each value in rect is the
+// coordinate that the border falls on. Scan lines and the result are recorded
+// in trace if it's not nil.
+func FindSelecters(img image.Image, scale Scale, trace *Trace,
+) (rect image.Rectangle, grey color.Color, err error) {
+	bounds := img.Bounds()
+	step := scale.Step()
+	// First look for the right border halfway down the window
+	y := (bounds.Max.Y - bounds.Min.Y) / 2
+	x0 := bounds.Max.X - scale.Px(WINDOW_BORDER)
+	x, grey, ok := findSelecterRight(img, x0, y, step)
+	if !ok {
+		trace.addScanLine(x0, y, x, y, false)
 		err = fmt.Errorf("Right edge of selecter region not found")
 		return
 	}
+	trace.addScanLine(x0, y, x, y, true)
 	rect.Max.X = x
     //log.Printf("Right edge at (%d,%d), grey %v", x, y, grey)
-	rect.Min.X = x - PADDED_SEL_TILE_WIDTH*SEL_COLUMNS + SEL_TILE_BORDER
+	rect.Min.X = x - scale.Px(PADDED_SEL_TILE_WIDTH*SEL_COLUMNS-SEL_TILE_BORDER)
 	// Verify the left edge
-	if !repton.VerifyBlackEdge(img,
-        rect.Min.X, y, -PIXEL_SCALE, 0, black, grey,
-    ) {
+	rect.Min.X, _, ok = verifyBlackEdge(img, rect.Min.X, y, -step, 0, scale,
+		grey)
+	if !ok {
+		trace.addScanLine(rect.Min.X-step, y, rect.Min.X, y, false)
 		return rect, grey, fmt.Errorf("Left edge of selecter region not found")
 	}
 	// From here find the top edge; 100 is arbitrary; x is still right edge
 	// because left may have the white dotted outline cursor in the way
-	for ; y > 100 * PIXEL_SCALE; y-- {
+	y0 := y
+	for ; y > scale.Px(100); y-- {
 		px := img.At(x, y)
 		if repton.ColourMatch(px, black) > repton.GOOD_MATCH {
 			break
 		}
 	}
-	if y <= 100 * PIXEL_SCALE {
+	if y <= scale.Px(100) {
+		trace.addScanLine(x, y0, x, y, false)
 		err = fmt.Errorf("Top edge of selecter region not found")
 		return
 	}
 	// Make sure this is a valid edge
 	y++
 	rect.Min.Y = y
-	if !repton.VerifyBlackEdge(img, x, y, 0, -PIXEL_SCALE, black, grey) {
+	if !repton.VerifyBlackEdge(img, x, y, 0, -step, black, grey) {
+		trace.addScanLine(x, y0, x, y-step, false)
 		err = fmt.Errorf("Top edge of selecter region not found")
 		return
 	}
-	y += PADDED_SEL_TILE_HEIGHT*SEL_ROWS - PIXEL_SCALE
+	trace.addScanLine(x, y0, x, y, true)
+	y += scale.Px(PADDED_SEL_TILE_HEIGHT*SEL_ROWS - SEL_TILE_BORDER)
+	_, y, ok = verifyBlackEdge(img, x, y, 0, step, scale, grey)
 	rect.Max.Y = y
-	if !repton.VerifyBlackEdge(img, x, y, 0, PIXEL_SCALE, black, grey) {
+	if !ok {
+		trace.addScanLine(x, y0, x, y+step, false)
 		err = fmt.Errorf("Bottom edge of selecter region not found")
 		return
 	}
+	trace.setSelecters(rect)
 	return rect, grey, nil
 }
 
 // FindMapRow finds the extremities of the map portion of the snapshot. x and
 // y should be on the left edge of the selecter area, approximately halfway
-// down.  The result has inclusive Min and exclusive Max.
-func FindMapRow(img image.Image, x, y int, grey color.Color,
+// down.  The result has inclusive Min and exclusive Max. The pixels scanned
+// are recorded in trace.
+func FindMapRow(img image.Image, x, y int, scale Scale, grey color.Color,
+	trace *Trace,
 ) (minX, maxX int, err error) {
 	x--
+	x0 := x
+	defer func() {
+		trace.addScanLine(x0, y, max(x, 0), y, err == nil)
+	}()
 	// Somewhere left of that we should encounter a whitish plinth border
 	for ; x >= 0; x-- {
 		if repton.ColourMatch(img.At(x, y), grey) > repton.GOOD_MATCH {
@@ -145,21 +272,34 @@ func FindMapRow(img image.Image, x, y int, grey color.Color,
 	}
 	maxX = x + 1
 	// From here subtract MAP_TILE_WIDTH pixels at a time, looking for grey
-	for ; x >= 0; x -= MAP_TILE_WIDTH {
+	for n := 1; x >= 0; n++ {
 		if repton.ColourMatch(img.At(x, y), grey) < repton.GOOD_MATCH {
 			break
 		}
+		x = maxX - 1 - scale.Px(n*MAP_TILE_WIDTH)
 	}
 	if x < 0 {
 		err = fmt.Errorf("Couldn't find left edge of map")
 		return
 	}
+	if !scale.IsInt() {
+		// The tile width is only approximate, so we may have overshot
+		limit := x + scale.Px(MAP_TILE_WIDTH)
+		for x+1 < limit &&
+			repton.ColourMatch(img.At(x+1, y), grey) < repton.GOOD_MATCH {
+			x++
+		}
+	}
 	x++
 	minX = x
 	return
 }
 
-func FindMapTopAndBottom(img image.Image, x, y int, grey color.Color,
+// FindMapTopAndBottom finds the top and bottom of the map by scanning
+// vertically from (x, y), which should be within the map. The pixels scanned
+// are recorded in trace.
+func FindMapTopAndBottom(img image.Image, x, y int, scale Scale,
+	grey color.Color, trace *Trace,
 ) (minY, maxY int, err error) {
 	// Now start looking up for top edge; better to use right edge just in case
 	// something drastic's happened to the "Level n" label
@@ -169,6 +309,7 @@ func FindMapTopAndBottom(img image.Image, x, y int, grey color.Color,
 			break
 		}
 	}
+	trace.addScanLine(x, max(y, 0), x, y0, y > 0)
 	if y <= 0 {
 		err = fmt.Errorf("Couldn't find top edge of map")
 		return
@@ -176,51 +317,78 @@ func FindMapTopAndBottom(img image.Image, x, y int, grey color.Color,
 	y++
 	minY = y
 	// Don't need to start checking for grey again until we're below original y
-	for ; y <= y0; y += MAP_TILE_HEIGHT {
+	n := 1
+	for ; y <= y0; n++ {
+		y = minY + scale.Px(n*MAP_TILE_HEIGHT)
 	}
-	for ; y <= y0+32*MAP_TILE_HEIGHT; y += MAP_TILE_HEIGHT {
+	yStart := y
+	yLimit := y0 + scale.Px(32*MAP_TILE_HEIGHT)
+	for ; y <= yLimit; n++ {
 		if repton.ColourMatch(img.At(x, y), grey) < repton.GOOD_MATCH {
 			break
 		}
+		y = minY + scale.Px(n*MAP_TILE_HEIGHT)
 	}
-	if y > y0+32*MAP_TILE_HEIGHT {
+	trace.addScanLine(x, yStart, x, y, y <= yLimit)
+	if y > yLimit {
 		err = fmt.Errorf("Couldn't find bottom edge of map")
 		return
 	}
+	if !scale.IsInt() {
+		// The tile height is only approximate, so we may have overshot
+		limit := y - scale.Px(MAP_TILE_HEIGHT)
+		for y-1 > limit &&
+			repton.ColourMatch(img.At(x, y-1), grey) < repton.GOOD_MATCH {
+			y--
+		}
+	}
 	maxY = y
 	return
 }
 
 // FindMap finds the extremities of the map portion of the snapshot. x and y
 // should be on the left edge of the selecter area, approximately halfway down.
-// The result has inclusive Min and exclusive Max.
-func FindMap(img image.Image, x, y int) (rect image.Rectangle, err error) {
+// The result has inclusive Min and exclusive Max. Scan lines and the result are
+// recorded in trace. Several rows are tried; if none of them lead to the map,
+// the error says why each one failed.
+func FindMap(img image.Image, x, y int, scale Scale, trace *Trace,
+) (rect image.Rectangle, err error) {
 	// Immediately left of the selecter is a verified grey region
 	x--
 	grey := img.At(x, y)
 	found := false
+	// Why each row failed, for the error if they all do
+	var failures []string
 	for n := 0; n < 20; n++ {
-		minX, maxX, err := FindMapRow(img, x, y+n, grey)
+		minX, maxX, err := FindMapRow(img, x, y+n, scale, grey, trace)
 		if err != nil {
-			log.Printf("FindMapRow failed at row %d: %v", y+n, err)
+			failures = append(failures,
+				fmt.Sprintf("FindMapRow failed at row %d: %v", y+n, err))
 			continue
 		}
-		minY1, maxY1, err := FindMapTopAndBottom(img, minX, y+n, grey)
+		minY1, maxY1, err := FindMapTopAndBottom(img, minX, y+n, scale, grey,
+			trace)
 		if err != nil {
-			log.Printf("FindMapTopAndBottom failed for minX at row %d: %v",
-				y+n, err)
+			failures = append(failures, fmt.Sprintf(
+				"FindMapTopAndBottom failed for minX at row %d: %v", y+n, err))
 			continue
 		}
-		minY2, maxY2, err := FindMapTopAndBottom(img, maxX-1, y+n, grey)
+		minY2, maxY2, err := FindMapTopAndBottom(img, maxX-1, y+n, scale,
+			grey, trace)
 		if err != nil {
-			log.Printf("FindMapTopAndBottom failed for maxX at row %d): %v",
-				y+n, err)
+			failures = append(failures, fmt.Sprintf(
+				"FindMapTopAndBottom failed for maxX at row %d: %v", y+n, err))
 			continue
 		}
-		if minY1 != minY2 || maxY1 != maxY2 {
-			log.Printf(
-                "FindMapTopAndBottom mismatch at row %d: (%d,%d) vs (%d,%d)",
-				y+n, minY1, maxY1, minY2, maxY2)
+		// Fractional scaling may blur the edges by a pixel
+		slack := 0
+		if !scale.IsInt() {
+			slack = 1
+		}
+		if abs(minY1-minY2) > slack || abs(maxY1-maxY2) > slack {
+			failures = append(failures, fmt.Sprintf(
+				"FindMapTopAndBottom mismatch at row %d: (%d,%d) vs (%d,%d)",
+				y+n, minY1, maxY1, minY2, maxY2))
 			continue
 		}
 		found = true
@@ -228,19 +396,23 @@ func FindMap(img image.Image, x, y int) (rect image.Rectangle, err error) {
 		rect.Max.X = maxX
 		rect.Min.Y = minY1
 		rect.Max.Y = maxY1
-        //log.Printf("Map bounds %v", rect)
+		trace.setMap(rect)
 		break
 	}
 	if !found {
-		err = fmt.Errorf("Completely failed to find map")
+		err = fmt.Errorf("Completely failed to find map:\n  %s",
+			strings.Join(failures, "\n  "))
 	}
 	return
 }
 
 // GetMapColourTheme samples a particular pixel from the selecter region
-// (r) to determine the map's colour theme
-func GetMapColourTheme(img image.Image, r image.Rectangle) int {
-	return repton.DetectColourTheme(img.At(
-        r.Min.X + 5*PADDED_SEL_TILE_WIDTH + 9 * PIXEL_SCALE, 
-		r.Min.Y + 9 * PIXEL_SCALE))
+// (r) to determine the map's colour theme. The pixel is recorded in trace.
+func GetMapColourTheme(img image.Image, r image.Rectangle, scale Scale,
+	trace *Trace,
+) int {
+	p := image.Point{r.Min.X + scale.Px(5*PADDED_SEL_TILE_WIDTH+9),
+		r.Min.Y + scale.Px(9)}
+	trace.setThemePixel(p)
+	return repton.DetectColourTheme(img.At(p.X, p.Y))
 }
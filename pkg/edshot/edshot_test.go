@@ -0,0 +1,177 @@
+package edshot
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+var testGrey = color.RGBA{192, 192, 192, 255}
+
+// fillRect fills a region of img with a colour.
+func fillRect(img draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// drawSelecterBorder draws the black border of the selecter region at the
+// given scale, with its right edge ending at x1 and its top at y0.
+func drawSelecterBorder(img draw.Image, x1, y0, scale int) {
+	w := (PADDED_SEL_TILE_WIDTH*SEL_COLUMNS - SEL_TILE_BORDER) * scale
+	h := (PADDED_SEL_TILE_HEIGHT*SEL_ROWS - SEL_TILE_BORDER) * scale
+	x0 := x1 - w - scale + 1
+	fillRect(img, image.Rect(x0, y0, x1+1, y0+scale), black)
+	fillRect(img, image.Rect(x0, y0+h, x1+1, y0+h+scale), black)
+	fillRect(img, image.Rect(x0, y0, x0+scale, y0+h+scale), black)
+	fillRect(img, image.Rect(x1-scale+1, y0, x1+1, y0+h+scale), black)
+}
+
+func TestDetectPixelScale(t *testing.T) {
+	tests := []struct {
+		name  string
+		scale int
+		decoy bool
+	}{
+		{"1x", 1, false},
+		{"2x", 2, false},
+		{"3x", 3, false},
+		// A dark segment of the window frame as high as a 1x selecter
+		{"2x with dark frame", 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := test.scale
+			img := image.NewRGBA(image.Rect(0, 0, 400*s, 300*s))
+			fillRect(img, img.Bounds(), testGrey)
+			x1 := img.Bounds().Max.X - 1 - (WINDOW_BORDER+20)*s
+			drawSelecterBorder(img, x1, 40*s, s)
+			if test.decoy {
+				x := img.Bounds().Max.X - 1 - WINDOW_BORDER - 4
+				h := PADDED_SEL_TILE_HEIGHT * SEL_ROWS
+				y := img.Bounds().Dy()/2 - h/2
+				fillRect(img, image.Rect(x, y, x+1, y+h), black)
+			}
+			scale, err := DetectPixelScale(img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scale != Scale(s) {
+				t.Errorf("detected scale %g, expected %d", scale, s)
+			}
+		})
+	}
+}
+
+// Colours of the parts of the editor's window drawn by fakeScreenshot
+var (
+	testTrench = color.RGBA{64, 64, 64, 255}
+	testPlinth = color.RGBA{240, 240, 240, 255}
+)
+
+// fakeScreenshot draws an editor screenshot at the given scale showing m,
+// with each tile drawn with sprts[tile]. The selecter region is filled with
+// themeColour, so that it's detected by GetMapColourTheme unless it's grey.
+// Only the features which LocateMap looks for are drawn.
+func fakeScreenshot(m *repton2.Map, sprts []image.Image,
+	themeColour color.Color, scale int,
+) *image.RGBA {
+	mapW, mapH := m.Width*MAP_TILE_WIDTH, m.Height*MAP_TILE_HEIGHT
+	// The middle row of the window crosses the selecter and the map
+	mid := max(60+mapH/2, 220)
+	mapX0, mapY0 := 20, mid-mapH/2
+	mapX1 := mapX0 + mapW
+	selX0 := mapX1 + 24
+	selY0 := mid - PADDED_SEL_TILE_HEIGHT*SEL_ROWS/2
+	w := selX0 + PADDED_SEL_TILE_WIDTH*SEL_COLUMNS + 24
+	normal := image.NewRGBA(image.Rect(0, 0, w, 2*mid))
+	fillRect(normal, normal.Bounds(), testGrey)
+	for y := 0; y < m.Height; y++ {
+		for x := 0; x < m.Width; x++ {
+			drawScaled(normal, sprts[m.At(x, y)],
+				mapX0+x*MAP_TILE_WIDTH, mapY0+y*MAP_TILE_HEIGHT, 1, 1)
+		}
+	}
+	// Between the map and the selecter are grey, a trench, more grey, the
+	// plinth's border and more grey
+	fillRect(normal, image.Rect(mapX1+8, 0, mapX1+12, 2*mid), testTrench)
+	fillRect(normal, image.Rect(mapX1+16, 0, mapX1+18, 2*mid), testPlinth)
+	selX1 := selX0 + PADDED_SEL_TILE_WIDTH*SEL_COLUMNS - SEL_TILE_BORDER
+	selY1 := selY0 + PADDED_SEL_TILE_HEIGHT*SEL_ROWS - SEL_TILE_BORDER
+	fillRect(normal, image.Rect(selX0, selY0, selX1+1, selY1+1), themeColour)
+	drawSelecterBorder(normal, selX1, selY0, 1)
+	if scale == 1 {
+		return normal
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w*scale, 2*mid*scale))
+	drawScaled(img, normal, 0, 0, scale, 1)
+	return img
+}
+
+// testSprites makes random sprites for each theme and tile type.
+func testSprites(rng *rand.Rand) map[string][]image.Image {
+	set := make(map[string][]image.Image)
+	for _, theme := range repton.ColourNames[:repton.KC_BLACK] {
+		sprts := make([]image.Image, repton2.N_TILES)
+		for t := range sprts {
+			sprts[t] = randomSprite(rng)
+		}
+		set[theme] = sprts
+	}
+	return set
+}
+
+// testMap makes a map of the given size using every tile type except puzzle,
+// apart from the puzzle pieces at the positions in puzzles.
+func testMap(rng *rand.Rand, theme string, width, height int,
+	puzzles []image.Point,
+) *repton2.Map {
+	m := repton2.NewMap(theme, width, height)
+	for i := range m.Tiles {
+		m.Tiles[i] = rng.Intn(repton2.T_PUZZLE)
+	}
+	for _, p := range puzzles {
+		m.Set(p.X, p.Y, repton2.T_PUZZLE)
+	}
+	return m
+}
+
+// spriteHashes makes reference hashes from a set of sprites, leaving out
+// puzzle pieces.
+func spriteHashes(set map[string][]image.Image) RefHashes {
+	refs := make(RefHashes)
+	for theme, sprts := range set {
+		hashes := make([]uint32, len(sprts))
+		for t, sprt := range sprts {
+			if t != repton2.T_PUZZLE {
+				hashes[t], _ = HashSprite(sprt)
+			}
+		}
+		refs.SetTheme(theme, hashes)
+	}
+	return refs
+}
+
+func TestLocateMapFailureDetails(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	set := testSprites(rng)
+	m := testMap(rng, "Green", 24, 20, nil)
+	img := fakeScreenshot(m, set["Green"], testGrey, 2)
+	// Hide the map's top left tile, at (20, 70) at normal size, so that the
+	// top of its left edge doesn't match the right edge's
+	fillRect(img, image.Rect(0, 0, 2*(20+MAP_TILE_WIDTH),
+		2*(70+MAP_TILE_HEIGHT)), testGrey)
+	_, _, _, err := LocateMap(img, "test.png", nil)
+	if err == nil {
+		t.Fatal("map was found")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "'test.png'") ||
+		strings.Count(msg, "FindMapTopAndBottom mismatch at row") != 20 {
+		t.Errorf("error doesn't give details of each row: %s", msg)
+	}
+}
@@ -0,0 +1,83 @@
+package edshot
+
+import (
+	"image"
+	"math"
+
+	"github.com/realh/repmap/pkg/repton"
+)
+
+const (
+	// FUZZY_THRESHOLD is the default maximum distance for FuzzyMatch
+	FUZZY_THRESHOLD = 0.05
+)
+
+// TileDistance compares region r of img with ref, which may be a different
+// size; they are both sampled at MAP_TILE_WIDTH x MAP_TILE_HEIGHT
+// points. The result is the mean of repton.ColourMatch over those points, so 0
+// is a perfect match and 1 is a complete mismatch.
+func TileDistance(img image.Image, r image.Rectangle, ref image.Image) float64 {
+	rb := ref.Bounds()
+	imgPixels := repton.NewPixelReader(img)
+	refPixels := repton.NewPixelReader(ref)
+	total := 0.0
+	for y := 0; y < MAP_TILE_HEIGHT; y++ {
+		iy := r.Min.Y + (2*y+1)*r.Dy()/(2*MAP_TILE_HEIGHT)
+		ry := rb.Min.Y + (2*y+1)*rb.Dy()/(2*MAP_TILE_HEIGHT)
+		for x := 0; x < MAP_TILE_WIDTH; x++ {
+			ix := r.Min.X + (2*x+1)*r.Dx()/(2*MAP_TILE_WIDTH)
+			rx := rb.Min.X + (2*x+1)*rb.Dx()/(2*MAP_TILE_WIDTH)
+			r1, g1, b1, _ := imgPixels.RGBA(ix, iy)
+			r2, g2, b2, _ := refPixels.RGBA(rx, ry)
+			total += repton.ColourMatchRGB(r1, g1, b1, r2, g2, b2)
+		}
+	}
+	return total / (MAP_TILE_WIDTH * MAP_TILE_HEIGHT)
+}
+
+// FuzzyMatch finds which of refs, indexed by tile type, is closest to region r
+// of img according to TileDistance. nil refs are skipped. If the distance of
+// the best match isn't less than threshold, tile is -1. distance is returned
+// either way.
+func FuzzyMatch(img image.Image, r image.Rectangle, refs []image.Image,
+	threshold float64,
+) (tile int, distance float64) {
+	tile = -1
+	distance = math.Inf(1)
+	for t, ref := range refs {
+		if ref == nil {
+			continue
+		}
+		d := TileDistance(img, r, ref)
+		if d < distance {
+			tile = t
+			distance = d
+		}
+	}
+	if distance >= threshold {
+		tile = -1
+	}
+	return
+}
+
+// FuzzyClassifier is a TileClassifier which uses FuzzyMatch to compare tiles
+// with a reference sprite for each tile type.
+type FuzzyClassifier struct {
+	// Sprites is indexed by colour theme, then by tile type, like sprites.Set
+	Sprites   map[string][]image.Image
+	Threshold float64
+}
+
+func (c *FuzzyClassifier) Classify(img image.Image, r image.Rectangle,
+	theme string,
+) Classification {
+	refs := c.Sprites[theme]
+	if refs == nil {
+		return Unknown
+	}
+	t, d := FuzzyMatch(img, r, refs, c.Threshold)
+	if t == -1 {
+		return Unknown
+	}
+	return Classification{t, METHOD_FUZZY, 1 - d}
+}
@@ -0,0 +1,120 @@
+package edshot
+
+import (
+	"image"
+	"math"
+
+	"github.com/realh/repmap/pkg/repton"
+)
+
+// Scale is the ratio of a screenshot's size to the editor's normal size. It's
+// 2 on hidpi screens, but may be fractional, eg 1.25 with Windows' 125%
+// display scaling.
+type Scale float64
+
+// Px converts a length in the editor's normal pixels to screenshot pixels.
+func (s Scale) Px(n int) int {
+	return int(math.Round(float64(n) * float64(s)))
+}
+
+// Step is the number of screenshot pixels to step over when scanning so that
+// each pixel at normal size is only sampled about once.
+func (s Scale) Step() int {
+	return max(1, int(s))
+}
+
+// IsInt returns true if s is a whole number, in which case edges etc fall
+// exactly where expected.
+func (s Scale) IsInt() bool {
+	return s == Scale(math.Round(float64(s)))
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Grid gives the positions of a map's tiles in a screenshot. Tiles are only a
+// whole number of pixels in size if the screenshot's Scale is a whole number,
+// so in general each tile's position is rounded.
+type Grid struct {
+	Bounds        image.Rectangle
+	Columns, Rows int
+}
+
+// NewGrid works out how many columns and rows of tiles there are in a map
+// region bounded by bounds. The tile pitch is then given by the region's size,
+// which is more accurate than scale.
+func NewGrid(bounds image.Rectangle, scale Scale) Grid {
+	w := float64(MAP_TILE_WIDTH) * float64(scale)
+	h := float64(MAP_TILE_HEIGHT) * float64(scale)
+	return Grid{bounds,
+		int(math.Round(float64(bounds.Dx()) / w)),
+		int(math.Round(float64(bounds.Dy()) / h))}
+}
+
+// Pitch returns the width and height of each tile in pixels.
+func (g Grid) Pitch() (float64, float64) {
+	return float64(g.Bounds.Dx()) / float64(g.Columns),
+		float64(g.Bounds.Dy()) / float64(g.Rows)
+}
+
+// IntScale returns the grid's scale if every tile is exactly MAP_TILE_WIDTH x
+// MAP_TILE_HEIGHT multiplied by a whole number, otherwise 0.
+func (g Grid) IntScale() int {
+	if g.Columns < 1 || g.Rows < 1 {
+		return 0
+	}
+	s := g.Bounds.Dx() / (g.Columns * MAP_TILE_WIDTH)
+	if s < 1 || g.Bounds.Dx() != g.Columns*MAP_TILE_WIDTH*s ||
+		g.Bounds.Dy() != g.Rows*MAP_TILE_HEIGHT*s {
+		return 0
+	}
+	return s
+}
+
+// TileRect returns the region of the tile at map tile coordinates (x, y).
+func (g Grid) TileRect(x, y int) image.Rectangle {
+	b := g.Bounds
+	return image.Rect(
+		b.Min.X+x*b.Dx()/g.Columns, b.Min.Y+y*b.Dy()/g.Rows,
+		b.Min.X+(x+1)*b.Dx()/g.Columns, b.Min.Y+(y+1)*b.Dy()/g.Rows)
+}
+
+// ExtractTile copies the tile at map tile coordinates (x, y) from img at its
+// normal size, ie MAP_TILE_WIDTH x MAP_TILE_HEIGHT, sampling the middle of
+// each pixel. Positions are worked out relative to the whole map rather than
+// TileRect so that rounding errors don't build up.
+func (g Grid) ExtractTile(img image.Image, x, y int) *image.RGBA {
+	tile := image.NewRGBA(image.Rect(0, 0, MAP_TILE_WIDTH, MAP_TILE_HEIGHT))
+	pixels := repton.NewPixelReader(img)
+	w := 2 * g.Columns * MAP_TILE_WIDTH
+	h := 2 * g.Rows * MAP_TILE_HEIGHT
+	for ty := 0; ty < MAP_TILE_HEIGHT; ty++ {
+		sy := g.Bounds.Min.Y +
+			(2*(y*MAP_TILE_HEIGHT+ty)+1)*g.Bounds.Dy()/h
+		row := tile.Pix[ty*tile.Stride:]
+		for tx := 0; tx < MAP_TILE_WIDTH; tx++ {
+			sx := g.Bounds.Min.X +
+				(2*(x*MAP_TILE_WIDTH+tx)+1)*g.Bounds.Dx()/w
+			row[tx*4], row[tx*4+1], row[tx*4+2], row[tx*4+3] =
+				pixels.RGBA8(sx, sy)
+		}
+	}
+	return tile
+}
+
+// TileImage returns the tile at map tile coordinates (x, y) in the form
+// expected by HashTile and TileClassifier: img and the tile's region if the
+// tiles are a whole multiple of their normal size, otherwise a copy extracted
+// with ExtractTile and its bounds.
+func (g Grid) TileImage(img image.Image, x, y int,
+) (image.Image, image.Rectangle) {
+	if g.IntScale() != 0 {
+		return img, g.TileRect(x, y)
+	}
+	tile := g.ExtractTile(img, x, y)
+	return tile, tile.Bounds()
+}
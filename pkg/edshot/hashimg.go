@@ -3,24 +3,30 @@ package edshot
 import (
 	"hash/crc32"
 	"image"
+
+	"github.com/realh/repmap/pkg/repton"
 )
 
-// HashImage computes a hash value for an image based on its RGBA values.
-func HashImage(img image.Image, bounds image.Rectangle) uint32 {
+// HashImage computes a hash value for an image based on its RGBA values. Only
+// every scale'th pixel is sampled in each direction, so the result is the
+// same as for the image at its normal size.
+func HashImage(img image.Image, bounds image.Rectangle, scale int) uint32 {
 	hash := crc32.NewIEEE()
-	row := make([]byte, (bounds.Max.X-bounds.Min.X)*4 / PIXEL_SCALE)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y += PIXEL_SCALE {
+	row := make([]byte, (bounds.Max.X-bounds.Min.X)*4/scale)
+	// At normal size the rows of an RGBA image are already in the right format
+	rgba, isRGBA := img.(*image.RGBA)
+	isRGBA = isRGBA && scale == 1 && bounds.In(rgba.Rect)
+	pixels := repton.NewPixelReader(img)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += scale {
+		if isRGBA {
+			i := rgba.PixOffset(bounds.Min.X, y)
+			hash.Write(rgba.Pix[i : i+len(row)])
+			continue
+		}
 		i := 0
-		for x := bounds.Min.X; x < bounds.Max.X; x += PIXEL_SCALE {
-			r, g, b, a := img.At(x, y).RGBA()
-			row[i] = uint8(r >> 8)
-			i++
-			row[i] = uint8(g >> 8)
-			i++
-			row[i] = uint8(b >> 8)
-			i++
-			row[i] = uint8(a >> 8)
-			i++
+		for x := bounds.Min.X; x < bounds.Max.X; x += scale {
+			row[i], row[i+1], row[i+2], row[i+3] = pixels.RGBA8(x, y)
+			i += 4
 		}
 		hash.Write(row)
 	}
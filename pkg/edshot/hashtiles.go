@@ -1,36 +1,66 @@
 package edshot
 
-import "image"
+import (
+	"fmt"
+	"image"
 
-// HashMapTiles generates a hash for each tile defined by map tile coordinates
-// in positions in img with map region bounded by bounds.
-func HashMapTiles(img image.Image, bounds image.Rectangle,
-	positions []image.Point,
-) (hashes []uint32) {
-	n := len(positions)
-	hashes = make([]uint32, n)
-	ch := make(chan bool, n)
-	for i, point := range positions {
-		go func(i int, point image.Point) {
-			// Negative coords mean don't hash, used for puzzle pieces
-			if point.X < 0 || point.Y < 0 {
-				hashes[i] = 0
-				ch <- false
-			} else {
-				b := image.Rectangle{
-					Min: image.Point{point.X * MAP_TILE_WIDTH,
-						point.Y * MAP_TILE_HEIGHT},
-				}
-				b.Min = b.Min.Add(bounds.Min)
-				b.Max = b.Min.Add(image.Point{MAP_TILE_WIDTH, MAP_TILE_HEIGHT})
-				hashes[i] = HashImage(img, b)
-				ch <- true
-			}
-		}(i, point)
+	"github.com/realh/repmap/pkg/repton"
+)
+
+// HashTile hashes the single tile in region r of img. Unless the region is
+// MAP_TILE_WIDTH x MAP_TILE_HEIGHT, or a whole multiple of that, it's
+// resampled to its normal size first. Tiles in a map should be passed as
+// returned by Grid.TileImage, which resamples them more accurately.
+func HashTile(img image.Image, r image.Rectangle) uint32 {
+	s := r.Dx() / MAP_TILE_WIDTH
+	if s >= 1 && r.Dx() == s*MAP_TILE_WIDTH && r.Dy() == s*MAP_TILE_HEIGHT {
+		return HashImage(img, r, s)
 	}
-	// await
-	for range positions {
-		<-ch
+	tile := Grid{r, 1, 1}.ExtractTile(img, 0, 0)
+	return HashImage(tile, tile.Bounds(), 1)
+}
+
+// HashSprite hashes a sprite in the same way that HashMapTiles would hash it
+// if it appeared in a screenshot, so that reference hashes can be made from
+// sprites. A sprite which is MAP_TILE_WIDTH x MAP_TILE_HEIGHT, or a whole
+// multiple of that such as the tiles saved by img2map -learn, is hashed pixel
+// for pixel. Other sizes, eg the 64 x 64 sprites extracted by extractatlases,
+// are resampled to the editor's tile size by sampling the middle of each
+// pixel, as HashMapTiles does for screenshots at a fractional scale. Sprites
+// smaller than a tile are rejected.
+func HashSprite(img image.Image) (uint32, error) {
+	b := img.Bounds()
+	if b.Dx() < MAP_TILE_WIDTH || b.Dy() < MAP_TILE_HEIGHT {
+		return 0, fmt.Errorf("sprite is %d x %d, smaller than %d x %d",
+			b.Dx(), b.Dy(), MAP_TILE_WIDTH, MAP_TILE_HEIGHT)
 	}
+	return HashTile(img, b), nil
+}
+
+// HashMapTiles generates a hash for each tile defined by map tile coordinates
+// in positions in img with map tiles in grid. Unless the tiles are a whole
+// multiple of their normal size, each one is resampled to its normal size
+// before hashing. The work is shared by repton.ForEachParallel.
+func HashMapTiles(img image.Image, grid Grid, positions []image.Point,
+) (hashes []uint32) {
+	hashes = make([]uint32, len(positions))
+	repton.ForEachParallel(len(positions), func(i int) {
+		point := positions[i]
+		// Negative coords mean don't hash, used for puzzle pieces
+		if point.X >= 0 && point.Y >= 0 {
+			hashes[i] = HashTile(grid.TileImage(img, point.X, point.Y))
+		}
+	})
 	return
 }
+
+// HashGrid returns the hashes of all the tiles in grid, row by row.
+func HashGrid(img image.Image, grid Grid) []uint32 {
+	positions := make([]image.Point, 0, grid.Columns*grid.Rows)
+	for y := 0; y < grid.Rows; y++ {
+		for x := 0; x < grid.Columns; x++ {
+			positions = append(positions, image.Point{x, y})
+		}
+	}
+	return HashMapTiles(img, grid, positions)
+}
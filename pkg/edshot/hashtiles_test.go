@@ -0,0 +1,177 @@
+package edshot
+
+import (
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+// randomSprite makes a MAP_TILE_WIDTH x MAP_TILE_HEIGHT sprite of random
+// opaque pixels.
+func randomSprite(rng *rand.Rand) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, MAP_TILE_WIDTH, MAP_TILE_HEIGHT))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rng.Intn(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+// drawScaled draws src into img with its top left at (x0, y0), scaled by
+// num/den in the way a screenshot would show it, ie each screenshot pixel is
+// the nearest pixel of src.
+func drawScaled(img *image.RGBA, src image.Image, x0, y0, num, den int) {
+	b := src.Bounds()
+	for y := 0; y < b.Dy()*num/den; y++ {
+		for x := 0; x < b.Dx()*num/den; x++ {
+			img.Set(x0+x, y0+y, src.At(b.Min.X+x*den/num, b.Min.Y+y*den/num))
+		}
+	}
+}
+
+func TestHashSpriteMatchesScreenshot(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	sprite := randomSprite(rng)
+	// Scales as num/den
+	scales := []struct{ num, den int }{{1, 1}, {2, 1}, {3, 1}, {3, 2}}
+	expected, err := HashSprite(sprite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sc := range scales {
+		scale := Scale(sc.num) / Scale(sc.den)
+		// A 3 x 2 map with the sprite at (1, 1) and random tiles elsewhere
+		const cols, rows = 3, 2
+		normal := image.NewRGBA(image.Rect(0, 0,
+			cols*MAP_TILE_WIDTH, rows*MAP_TILE_HEIGHT))
+		for y := 0; y < rows; y++ {
+			for x := 0; x < cols; x++ {
+				tile := sprite
+				if x != 1 || y != 1 {
+					tile = randomSprite(rng)
+				}
+				drawScaled(normal, tile, x*MAP_TILE_WIDTH,
+					y*MAP_TILE_HEIGHT, 1, 1)
+			}
+		}
+		img := image.NewRGBA(image.Rect(10, 20,
+			10+normal.Rect.Dx()*sc.num/sc.den,
+			20+normal.Rect.Dy()*sc.num/sc.den))
+		drawScaled(img, normal, 10, 20, sc.num, sc.den)
+		grid := NewGrid(img.Bounds(), scale)
+		hashes := HashMapTiles(img, grid, []image.Point{{1, 1}, {0, 0}})
+		if hashes[0] != expected {
+			t.Errorf("scale %g: screenshot tile hashed to %d, sprite to %d",
+				scale, hashes[0], expected)
+		}
+		if hashes[1] == expected {
+			t.Errorf("scale %g: different tile has the same hash", scale)
+		}
+	}
+	// A sprite at a whole multiple of its normal size, as saved from a
+	// hidpi screenshot, has the same hash
+	big := image.NewRGBA(image.Rect(0, 0, 2*MAP_TILE_WIDTH, 2*MAP_TILE_HEIGHT))
+	drawScaled(big, sprite, 0, 0, 2, 1)
+	if h, err := HashSprite(big); err != nil || h != expected {
+		t.Errorf("2x sprite hashed to %d (%v), expected %d", h, err, expected)
+	}
+}
+
+func TestHashSpriteResamplesOtherSizes(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	for _, size := range []image.Point{{64, 64}, {24, 22}, {40, 33}} {
+		// A 64 x 64 sprite from a sprite atlas is resampled the same way as a
+		// 64 x 64 tile in a screenshot
+		sprite := image.NewRGBA(image.Rectangle{Max: size})
+		for i := range sprite.Pix {
+			sprite.Pix[i] = byte(rng.Intn(256)) | 0x80
+		}
+		h, err := HashSprite(sprite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The sprite as the second of three tiles in a map
+		img := image.NewRGBA(image.Rect(0, 0, 3*size.X, size.Y))
+		for x := 0; x < 3; x++ {
+			tile := image.Image(sprite)
+			if x != 1 {
+				tile = randomSprite(rng)
+			}
+			drawScaled(img, tile, x*size.X, 0, size.X, tile.Bounds().Dx())
+		}
+		grid := Grid{img.Bounds(), 3, 1}
+		hashes := HashMapTiles(img, grid, []image.Point{{1, 0}})
+		if hashes[0] != h {
+			t.Errorf("%v sprite hashed to %d, but %d in a map", size, h,
+				hashes[0])
+		}
+		if h == HashImage(sprite, sprite.Bounds(), 1) {
+			t.Errorf("%v sprite wasn't resampled", size)
+		}
+	}
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 8, 8),
+		image.Rect(0, 0, 16, 14),
+		{},
+	} {
+		if _, err := HashSprite(image.NewRGBA(r)); err == nil {
+			t.Errorf("%d x %d sprite was hashed", r.Dx(), r.Dy())
+		}
+	}
+}
+
+// benchImages returns img as each of the formats repton.PixelReader reads
+// directly, plus one which has to be read with At.
+func benchImages(img *image.RGBA) []struct {
+	name string
+	img  image.Image
+} {
+	r := img.Bounds()
+	nrgba := image.NewNRGBA(r)
+	draw.Draw(nrgba, r, img, r.Min, draw.Src)
+	paletted := image.NewPaletted(r, palette.Plan9)
+	draw.Draw(paletted, r, img, r.Min, draw.Src)
+	return []struct {
+		name string
+		img  image.Image
+	}{
+		{"RGBA", img},
+		{"NRGBA", nrgba},
+		{"Paletted", paletted},
+		// Hides the concrete type
+		{"At", struct{ image.Image }{img}},
+	}
+}
+
+func BenchmarkHashImage(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	const cols, rows = 32, 32
+	for _, scale := range []int{1, 2} {
+		img := image.NewRGBA(image.Rect(0, 0,
+			cols*MAP_TILE_WIDTH*scale, rows*MAP_TILE_HEIGHT*scale))
+		for y := 0; y < rows; y++ {
+			for x := 0; x < cols; x++ {
+				drawScaled(img, randomSprite(rng), x*MAP_TILE_WIDTH*scale,
+					y*MAP_TILE_HEIGHT*scale, scale, 1)
+			}
+		}
+		grid := NewGrid(img.Bounds(), Scale(scale))
+		for _, bi := range benchImages(img) {
+			b.Run(fmt.Sprintf("%s/%dx", bi.name, scale), func(b *testing.B) {
+				// Hash every tile of a map, as HashGrid does
+				for i := 0; i < b.N; i++ {
+					for y := 0; y < rows; y++ {
+						for x := 0; x < cols; x++ {
+							HashImage(bi.img, grid.TileRect(x, y), scale)
+						}
+					}
+				}
+			})
+		}
+	}
+}
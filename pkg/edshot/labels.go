@@ -0,0 +1,101 @@
+package edshot
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+// LABELS_FILE is the name of the labels file in a folder written by img2map
+// -learn.
+const LABELS_FILE = "labels.csv"
+
+// Label is one line of a labels file, saying which tile type has a hash in a
+// theme. Each line of the file is in the format Theme,hash,name where name is
+// a tile name as in pkg/repton2/tiles.go, with or without the T_ prefix.
+type Label struct {
+	Theme string
+	Hash  uint32
+	Tile  int
+}
+
+// ParseLabel parses a line of a labels file. If the line has no name, ok is
+// false.
+func ParseLabel(line string) (label Label, ok bool, err error) {
+	fields := strings.Split(line, ",")
+	if len(fields) != 3 {
+		return label, false, fmt.Errorf("expected 3 fields, found %d",
+			len(fields))
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if fields[2] == "" {
+		return label, false, nil
+	}
+	if label.Theme, err = repton2.ParseTheme(fields[0]); err != nil {
+		return label, false, err
+	}
+	h, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return label, false, fmt.Errorf("invalid hash '%s'", fields[1])
+	}
+	label.Hash = uint32(h)
+	if label.Tile, ok = repton2.TileByName(fields[2]); !ok {
+		return label, false, fmt.Errorf("unknown tile '%s'", fields[2])
+	}
+	return label, true, nil
+}
+
+// LoadLabels loads a labels file, skipping lines without a name, blank lines
+// and lines starting with '#'.
+func LoadLabels(filename string) ([]Label, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var labels []Label
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		label, ok, err := ParseLabel(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, n, err)
+		}
+		if ok {
+			labels = append(labels, label)
+		}
+	}
+	return labels, scanner.Err()
+}
+
+// LoadLabelledSamples loads the tiles saved by img2map -learn in dir which
+// have been labelled in its LABELS_FILE, for use with NearestClassifier.
+func LoadLabelledSamples(dir string) ([]LabelledSample, error) {
+	labels, err := LoadLabels(filepath.Join(dir, LABELS_FILE))
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]LabelledSample, len(labels))
+	for i, l := range labels {
+		var img image.Image
+		img, err = repton.LoadImage(
+			filepath.Join(dir, l.Theme, fmt.Sprintf("%d.png", l.Hash)))
+		if err != nil {
+			return nil, err
+		}
+		samples[i] = LabelledSample{l.Theme, l.Tile, img}
+	}
+	return samples, nil
+}
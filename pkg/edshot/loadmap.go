@@ -8,9 +8,12 @@ import (
 )
 
 // LoadMap loads a map, given a filename, makes an Image from it and finds the
-// bounds of the tile selecter region and map region.
-func LoadMap(filename string) (img image.Image,
-	mapBounds image.Rectangle, selBounds image.Rectangle, e error,
+// bounds of the tile selecter region, the grid of map tiles, and the pixel
+// scale (see DetectPixelScale). If trace is not nil, the search is recorded in
+// it. img is returned even if the regions aren't found, provided the file was
+// decoded.
+func LoadMap(filename string, trace *Trace) (img image.Image, grid Grid,
+	selBounds image.Rectangle, scale Scale, e error,
 ) {
 	fd, err := os.Open(filename)
 	if err != nil {
@@ -23,17 +26,36 @@ func LoadMap(filename string) (img image.Image,
 		e = fmt.Errorf("Unable to decode '%s': %v", filename, err)
 		return
 	}
-	selBounds, _, err = FindSelecters(img)
+	grid, selBounds, scale, e = LocateMap(img, filename, trace)
+	return
+}
+
+// LocateMap is the part of LoadMap which analyses an image which has already
+// been loaded. name is used in error messages, normally the image's filename.
+func LocateMap(img image.Image, name string, trace *Trace) (grid Grid,
+	selBounds image.Rectangle, scale Scale, e error,
+) {
+	scale, err := DetectPixelScale(img, trace)
+	if err != nil {
+		e = fmt.Errorf("Unable to detect pixel scale of '%s': %v",
+			name, err)
+		return
+	}
+	selBounds, _, err = FindSelecters(img, scale, trace)
 	if err != nil {
 		e = fmt.Errorf("Unable to find selecter tiles in '%s': %v",
-			filename, err)
+			name, err)
 		return
 	}
-	mapBounds, err = FindMap(img, selBounds.Min.X,
-		(selBounds.Min.Y+selBounds.Max.Y)/2)
+	mapBounds, err := FindMap(img, selBounds.Min.X,
+		(selBounds.Min.Y+selBounds.Max.Y)/2, scale, trace)
 	if err != nil {
-		e = fmt.Errorf("Unable to find map region in '%s': %v", filename, err)
+		e = fmt.Errorf("Unable to find map region in '%s': %v", name, err)
 		return
 	}
+	grid = NewGrid(mapBounds, scale)
+	if grid.Columns < 1 || grid.Rows < 1 {
+		e = fmt.Errorf("Map region in '%s' is too small", name)
+	}
 	return
 }
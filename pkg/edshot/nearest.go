@@ -0,0 +1,74 @@
+package edshot
+
+import (
+	"image"
+	"sort"
+)
+
+// NEAREST_K is the default number of samples which vote in
+// NearestClassifier.
+const NEAREST_K = 3
+
+// LabelledSample is an image of a tile whose type is known. If Theme is empty
+// the sample applies to all themes.
+type LabelledSample struct {
+	Theme string
+	Tile  int
+	Img   image.Image
+}
+
+// NearestClassifier is a TileClassifier which compares tiles with any number
+// of labelled samples using TileDistance. Of the samples for the map's theme
+// which are closer than Threshold, the K nearest vote for their tile type.
+// The winner is the type with the most votes, or the nearest of the tied
+// types. Unlike FuzzyClassifier, there may be several samples of each tile
+// type, eg tiles collected from screenshots with different artefacts. The
+// confidence is 1 - the distance of the winner's nearest sample, multiplied
+// by the winner's share of the votes.
+type NearestClassifier struct {
+	Samples   []LabelledSample
+	K         int
+	Threshold float64
+}
+
+type sampleDistance struct {
+	tile     int
+	distance float64
+}
+
+func (c *NearestClassifier) Classify(img image.Image, r image.Rectangle,
+	theme string,
+) Classification {
+	var dists []sampleDistance
+	for _, s := range c.Samples {
+		if s.Theme != "" && s.Theme != theme {
+			continue
+		}
+		if d := TileDistance(img, r, s.Img); d < c.Threshold {
+			dists = append(dists, sampleDistance{s.Tile, d})
+		}
+	}
+	if len(dists) == 0 {
+		return Unknown
+	}
+	sort.Slice(dists, func(i, j int) bool {
+		return dists[i].distance < dists[j].distance
+	})
+	k := min(max(c.K, 1), len(dists))
+	votes := make(map[int]int)
+	nearest := make(map[int]float64)
+	best := -1
+	for _, d := range dists[:k] {
+		if votes[d.tile] == 0 {
+			nearest[d.tile] = d.distance
+		}
+		votes[d.tile]++
+		// The nearest samples come first, so a later tile must have more
+		// votes, not just as many, to win
+		if best == -1 || votes[d.tile] > votes[best] {
+			best = d.tile
+		}
+	}
+	return Classification{best, METHOD_NEAREST,
+		(1 - nearest[best]) * float64(votes[best]) / float64(k)}
+}
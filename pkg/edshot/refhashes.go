@@ -0,0 +1,298 @@
+package edshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+// Reference hash files come in two formats. Version 1, the original
+// reftilehashes.json, is an object mapping each colour theme to an array of
+// hashes indexed by tile type (the T_ constants), with 0 for puzzle pieces.
+// Version 2 has a "header" object (see RefHashesHeader) and a "themes" object
+// mapping each colour theme to an object of hashes keyed by tile name, with
+// puzzle pieces and other tiles without a reference hash left out. Each value
+// is a hash, or an array of hashes for a tile with several variants of its
+// sprite.
+const REF_HASHES_FORMAT = 2
+
+// HASH_ALGORITHM identifies the algorithm used by HashImage in version 2
+// reference hash files. It must be changed if the hashing changes.
+const HASH_ALGORITHM = "crc32-ieee-rgba"
+
+// RefHashesHeader is the header of a version 2 reference hashes file. Scale
+// is the pixel scale of the tiles the hashes are of; tiles are always hashed
+// at their normal size, so this is 1. Tiles lists the tile names in order of
+// the T_ constants when the file was written. Generator is the program which
+// wrote the file, and Source what the hashes were made from.
+type RefHashesHeader struct {
+	Format    int      `json:"format"`
+	Algorithm string   `json:"algorithm"`
+	Scale     int      `json:"scale"`
+	Tiles     []string `json:"tiles"`
+	Created   string   `json:"created,omitempty"`
+	Generator string   `json:"generator,omitempty"`
+	Source    string   `json:"source,omitempty"`
+}
+
+// NewRefHashesHeader returns a header for reference hashes being written now.
+func NewRefHashesHeader(generator, source string) *RefHashesHeader {
+	tiles := make([]string, repton2.N_TILES)
+	for t := range tiles {
+		tiles[t] = repton2.TileName(t)
+	}
+	return &RefHashesHeader{
+		Format:    REF_HASHES_FORMAT,
+		Algorithm: HASH_ALGORITHM,
+		Scale:     1,
+		Tiles:     tiles,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+		Generator: generator,
+		Source:    source,
+	}
+}
+
+// RefHashes holds reference hashes indexed by colour name, then by tile type
+// (the T_ constants). A tile may have several hashes, one for each variant of
+// its sprite that has been seen, or none if it has no reference.
+type RefHashes map[string][][]uint32
+
+// SetTheme sets a theme's hashes from hashes indexed by tile type, with one
+// hash per tile, or 0 for a tile without a reference, as in version 1 files.
+func (refs RefHashes) SetTheme(theme string, hashes []uint32) {
+	tiles := make([][]uint32, repton2.N_TILES)
+	for t, h := range hashes {
+		if h != 0 {
+			tiles[t] = []uint32{h}
+		}
+	}
+	refs[theme] = tiles
+}
+
+// Add adds hash to tile's reference hashes for theme, returning false if it
+// was already there.
+func (refs RefHashes) Add(theme string, tile int, hash uint32) bool {
+	tiles := refs[theme]
+	if len(tiles) < repton2.N_TILES {
+		tiles = append(tiles,
+			make([][]uint32, repton2.N_TILES-len(tiles))...)
+		refs[theme] = tiles
+	}
+	if slices.Contains(tiles[tile], hash) {
+		return false
+	}
+	tiles[tile] = append(tiles[tile], hash)
+	return true
+}
+
+// Remove removes hash from tile's reference hashes for theme, if it's there.
+func (refs RefHashes) Remove(theme string, tile int, hash uint32) {
+	if tiles := refs[theme]; tile < len(tiles) {
+		tiles[tile] = slices.DeleteFunc(tiles[tile],
+			func(h uint32) bool { return h == hash })
+	}
+}
+
+// refHashesV2 is the layout of a version 2 file. Each tile's value is a hash
+// or an array of hashes.
+type refHashesV2 struct {
+	Header *RefHashesHeader                      `json:"header"`
+	Themes map[string]map[string]json.RawMessage `json:"themes"`
+}
+
+// LoadRefHashes loads reference hashes from a JSON file such as
+// reftilehashes.json, in either format.
+func LoadRefHashes(filename string) (RefHashes, error) {
+	refs, _, err := LoadRefHashesWithHeader(filename)
+	return refs, err
+}
+
+// LoadRefHashesWithHeader is like LoadRefHashes but also returns the file's
+// header, which is nil for a version 1 file.
+func LoadRefHashesWithHeader(filename string,
+) (RefHashes, *RefHashesHeader, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fd.Close()
+	str, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs, header, err := ParseRefHashes(str)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return refs, header, nil
+}
+
+// ParseRefHashes parses the contents of a reference hashes file, as for
+// LoadRefHashesWithHeader.
+func ParseRefHashes(data []byte,
+) (RefHashes, *RefHashesHeader, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, nil, err
+	}
+	if _, ok := top["header"]; !ok {
+		refs, err := parseRefHashesV1(data)
+		return refs, nil, err
+	}
+	var v2 refHashesV2
+	if err := json.Unmarshal(data, &v2); err != nil {
+		return nil, nil, err
+	}
+	h := v2.Header
+	if h == nil {
+		return nil, nil, fmt.Errorf("missing header")
+	} else if h.Format != REF_HASHES_FORMAT {
+		return nil, nil, fmt.Errorf("unsupported format %d", h.Format)
+	}
+	if h.Algorithm != HASH_ALGORITHM {
+		return nil, nil, fmt.Errorf("unsupported hash algorithm '%s'",
+			h.Algorithm)
+	}
+	if h.Scale != 1 {
+		return nil, nil, fmt.Errorf("unsupported scale %d", h.Scale)
+	}
+	refs := make(RefHashes)
+	for theme, tiles := range v2.Themes {
+		refs[theme] = make([][]uint32, repton2.N_TILES)
+		for name, raw := range tiles {
+			t, ok := repton2.TileByName(name)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: unknown tile '%s'",
+					theme, name)
+			}
+			hashes, err := parseTileHashes(raw)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s %s: %v", theme, name, err)
+			}
+			for _, hash := range hashes {
+				refs.Add(theme, t, hash)
+			}
+		}
+	}
+	return refs, h, nil
+}
+
+// parseTileHashes parses a tile's value in a version 2 file, which is a hash
+// or an array of hashes.
+func parseTileHashes(raw json.RawMessage) ([]uint32, error) {
+	var hashes []uint32
+	if len(raw) != 0 && raw[0] == '[' {
+		err := json.Unmarshal(raw, &hashes)
+		return hashes, err
+	}
+	var hash uint32
+	err := json.Unmarshal(raw, &hash)
+	return []uint32{hash}, err
+}
+
+// parseRefHashesV1 parses a version 1 file. Arrays shorter than N_TILES are
+// padded with 0.
+func parseRefHashesV1(data []byte) (RefHashes, error) {
+	v1 := make(map[string][]uint32)
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return nil, err
+	}
+	refs := make(RefHashes)
+	for theme, hashes := range v1 {
+		if len(hashes) > repton2.N_TILES {
+			return nil, fmt.Errorf("%s has %d hashes, expected %d", theme,
+				len(hashes), repton2.N_TILES)
+		} else if len(hashes) != 0 {
+			refs.SetTheme(theme, hashes)
+		} else {
+			refs[theme] = nil
+		}
+	}
+	return refs, nil
+}
+
+// WriteRefHashes writes refs in the version 2 format with the given header
+// (see NewRefHashesHeader). Themes are written in the order of
+// repton.ColourNames and tiles in order of the T_ constants, one per line.
+// Themes which aren't in refs, and tiles without a hash, are omitted. A tile
+// with one hash is written as a number, otherwise as an array.
+func WriteRefHashes(w io.Writer, refs RefHashes,
+	header *RefHashesHeader,
+) error {
+	hdr, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	var themes []string
+	for _, clr := range repton.ColourNames {
+		hashes, ok := refs[clr]
+		if !ok {
+			continue
+		}
+		var lines []string
+		for t, hs := range hashes {
+			if len(hs) == 0 {
+				continue
+			}
+			value := fmt.Sprintf("%d", hs[0])
+			if len(hs) > 1 {
+				value = "[" + joinHashes(hs) + "]"
+			}
+			lines = append(lines, fmt.Sprintf(`      "%s": %s`,
+				repton2.TileName(t), value))
+		}
+		themes = append(themes, fmt.Sprintf("    \"%s\": {\n%s\n    }", clr,
+			strings.Join(lines, ",\n")))
+	}
+	_, err = fmt.Fprintf(w,
+		"{\n  \"header\": %s,\n  \"themes\": {\n%s\n  }\n}\n",
+		hdr, strings.Join(themes, ",\n"))
+	return err
+}
+
+// WriteRefHashesV1 writes refs in the version 1 format, as used by
+// reftilehashes.json, with one line per theme in the order of
+// repton.ColourNames. Themes which aren't in refs are omitted. Version 1 only
+// has room for one hash per tile, so it's an error if any tile has more.
+func WriteRefHashesV1(w io.Writer, refs RefHashes) error {
+	var lines []string
+	for _, clr := range repton.ColourNames {
+		hashes, ok := refs[clr]
+		if !ok {
+			continue
+		}
+		s := make([]string, len(hashes))
+		for t, hs := range hashes {
+			switch len(hs) {
+			case 0:
+				s[t] = "0"
+			case 1:
+				s[t] = fmt.Sprintf("%d", hs[0])
+			default:
+				return fmt.Errorf("%s %s has %d hashes, which can't be "+
+					"written in version 1 format", clr, repton2.TileName(t),
+					len(hs))
+			}
+		}
+		lines = append(lines,
+			fmt.Sprintf(`  "%s": [%s]`, clr, strings.Join(s, ", ")))
+	}
+	_, err := fmt.Fprintf(w, "{\n%s\n}\n", strings.Join(lines, ",\n"))
+	return err
+}
+
+// joinHashes formats hashes as a comma-separated list of decimal numbers.
+func joinHashes(hashes []uint32) string {
+	s := make([]string, len(hashes))
+	for i, h := range hashes {
+		s[i] = fmt.Sprintf("%d", h)
+	}
+	return strings.Join(s, ", ")
+}
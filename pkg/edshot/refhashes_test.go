@@ -0,0 +1,175 @@
+package edshot
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+func TestRefHashesV1ToV2(t *testing.T) {
+	data, err := os.ReadFile("../../reftilehashes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, header, err := ParseRefHashes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != nil {
+		t.Fatalf("reftilehashes.json has a header: %+v", header)
+	}
+	var buf bytes.Buffer
+	err = WriteRefHashes(&buf, v1, NewRefHashesHeader("test", "v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, header, err := ParseRefHashes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("%v in:\n%s", err, buf.String())
+	}
+	if header == nil || header.Format != REF_HASHES_FORMAT ||
+		len(header.Tiles) != repton2.N_TILES {
+		t.Errorf("header is %+v", header)
+	}
+	if !reflect.DeepEqual(v1, v2) {
+		t.Errorf("v2 hashes differ from v1:\n%v\n%v", v1, v2)
+	}
+	// And back again
+	buf.Reset()
+	if err := WriteRefHashesV1(&buf, v2); err != nil {
+		t.Fatal(err)
+	}
+	v1Again, _, err := ParseRefHashes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v1, v1Again) {
+		t.Errorf("v1 hashes changed after writing v2 and v1")
+	}
+}
+
+// v2Header is a valid version 2 header for tests.
+const v2Header = `"header": {"format": 2, "algorithm": "crc32-ieee-rgba",
+	"scale": 1, "tiles": []}`
+
+func TestParseRefHashesV2(t *testing.T) {
+	// Tiles without a hash, including puzzle, are left out; the names may
+	// have the T_ prefix and be in any case
+	refs, _, err := ParseRefHashes([]byte(`{` + v2Header + `,
+		"themes": {"Blue": {"DIAMOND": 12, "t_rock": 34}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := refs["Blue"]
+	if len(hashes) != repton2.N_TILES {
+		t.Fatalf("Blue has %d hashes, expected %d", len(hashes),
+			repton2.N_TILES)
+	}
+	for tile, hs := range hashes {
+		var expected []uint32
+		switch tile {
+		case repton2.T_DIAMOND:
+			expected = []uint32{12}
+		case repton2.T_ROCK:
+			expected = []uint32{34}
+		}
+		if !slices.Equal(hs, expected) {
+			t.Errorf("%s has hashes %v, expected %v", repton2.TileName(tile),
+				hs, expected)
+		}
+	}
+}
+
+func TestParseRefHashesErrors(t *testing.T) {
+	tests := []struct {
+		name, data, err string
+	}{
+		{"unknown tile",
+			`{` + v2Header + `, "themes": {"Red": {"DIMOND": 1}}}`,
+			"unknown tile 'DIMOND'"},
+		{"unsupported format",
+			`{"header": {"format": 3}, "themes": {}}`,
+			"unsupported format 3"},
+		{"unsupported algorithm",
+			`{"header": {"format": 2, "algorithm": "md5", "scale": 1}}`,
+			"unsupported hash algorithm"},
+		{"unsupported scale",
+			`{"header": {"format": 2, "algorithm": "crc32-ieee-rgba", ` +
+				`"scale": 2}}`,
+			"unsupported scale 2"},
+		{"missing header", `{"header": null}`, "missing header"},
+		{"too many v1 hashes",
+			`{"Blue": [` + strings.Repeat("1, ", repton2.N_TILES) + `1]}`,
+			"Blue has 35 hashes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := ParseRefHashes([]byte(test.data))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error is %v, expected '%s'", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseRefHashesShortV1(t *testing.T) {
+	// v1 files from before tiles were added are padded with 0
+	refs, _, err := ParseRefHashes([]byte(`{"Green": [5, 6]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := refs["Green"]
+	if len(hashes) != repton2.N_TILES ||
+		!slices.Equal(hashes[repton2.T_DIAMOND], []uint32{6}) ||
+		len(hashes[repton2.T_SKULL_RED]) != 0 {
+		t.Errorf("Green hashes are %v", hashes)
+	}
+}
+
+func TestRefHashesVariants(t *testing.T) {
+	refs := make(RefHashes)
+	refs.Add("Red", repton2.T_KEY, 7)
+	if !refs.Add("Red", repton2.T_KEY, 8) || refs.Add("Red", repton2.T_KEY, 7) {
+		t.Errorf("Add didn't add only the new variant")
+	}
+	var buf bytes.Buffer
+	err := WriteRefHashes(&buf, refs, NewRefHashesHeader("test", "variants"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"KEY": [7, 8]`) {
+		t.Errorf("variants aren't written as an array:\n%s", buf.String())
+	}
+	parsed, _, err := ParseRefHashes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, refs) {
+		t.Errorf("parsed %v, expected %v", parsed, refs)
+	}
+	// Both variants are recognised
+	c := NewHashClassifier(parsed)
+	for _, h := range []uint32{7, 8} {
+		if tile := c.ClassifyHash(h, "Red").Tile; tile != repton2.T_KEY {
+			t.Errorf("%d classified as %s", h, repton2.TileName(tile))
+		}
+	}
+	scores := ScoreThemes([]uint32{7, 8, 9}, parsed)
+	if scores[repton.KC_RED] != 2 {
+		t.Errorf("Red scored %d", scores[repton.KC_RED])
+	}
+	// Version 1 can't hold them
+	if err := WriteRefHashesV1(&buf, refs); err == nil {
+		t.Errorf("variants were written in version 1 format")
+	}
+	refs.Remove("Red", repton2.T_KEY, 7)
+	if !slices.Equal(refs["Red"][repton2.T_KEY], []uint32{8}) {
+		t.Errorf("after Remove, KEY has %v", refs["Red"][repton2.T_KEY])
+	}
+}
@@ -0,0 +1,102 @@
+package edshot
+
+import (
+	"image"
+
+	"github.com/realh/repmap/pkg/repton"
+)
+
+// Methods by which a map's colour theme may be detected, in the order they're
+// tried by DetectTheme
+const (
+	THEME_PIXEL    = "pixel"    // GetMapColourTheme
+	THEME_HASHES   = "hashes"   // Agreement of tile hashes with references
+	THEME_SELECTER = "selecter" // Dominant colour of the selecter region
+	THEME_NONE     = "none"     // Not detected
+)
+
+// MIN_THEME_LEAD is the minimum number of tiles by which the best theme must
+// beat the others in ScoreThemes for THEME_HASHES to be decisive.
+const MIN_THEME_LEAD = 3
+
+// ThemeDetection is the result of DetectTheme. Theme is an index into
+// repton.ColourNames, or -1 if it wasn't detected. Margin shows how clear the
+// decision was, from 0 to 1. For THEME_HASHES it's how many more tiles matched
+// the best theme than the second best, as a fraction of the map's tiles; for
+// THEME_SELECTER it's the equivalent for pixels; THEME_PIXEL is always 1.
+type ThemeDetection struct {
+	Theme  int
+	Method string
+	Margin float64
+}
+
+// ScoreThemes counts how many of hashes match each theme's reference hashes
+// in refs; any of a tile's variants counts. The result is indexed like
+// repton.ColourNames.
+func ScoreThemes(hashes []uint32, refs RefHashes) []int {
+	scores := make([]int, repton.KC_BLACK)
+	for i, clr := range repton.ColourNames[:repton.KC_BLACK] {
+		set := make(map[uint32]bool)
+		for _, hs := range refs[clr] {
+			for _, h := range hs {
+				set[h] = true
+			}
+		}
+		for _, h := range hashes {
+			if set[h] {
+				scores[i]++
+			}
+		}
+	}
+	return scores
+}
+
+// bestTwo returns the index and value of the highest value in counts and the
+// second highest value.
+func bestTwo(counts []int) (best, first, second int) {
+	best = -1
+	for i, n := range counts {
+		if best == -1 || n > first {
+			best, first, second = i, n, first
+		} else if n > second {
+			second = n
+		}
+	}
+	return
+}
+
+// DetectTheme works out the colour theme of a map. It first tries
+// GetMapColourTheme; if that fails it picks the theme whose reference hashes
+// in refs are matched by the most of hashes, the hashes of the map's tiles,
+// provided it's a clear winner. As a last resort it looks for the dominant
+// colour of the selecter region, bounded by r.
+func DetectTheme(img image.Image, r image.Rectangle, scale Scale,
+	hashes []uint32, refs RefHashes, trace *Trace,
+) ThemeDetection {
+	theme := GetMapColourTheme(img, r, scale, trace)
+	if theme != -1 && theme != repton.KC_BLACK {
+		return ThemeDetection{theme, THEME_PIXEL, 1}
+	}
+	if len(hashes) != 0 {
+		best, first, second := bestTwo(ScoreThemes(hashes, refs))
+		if first-second >= MIN_THEME_LEAD {
+			return ThemeDetection{best, THEME_HASHES,
+				float64(first-second) / float64(len(hashes))}
+		}
+	}
+	counts := repton.CountEachColourInRegion(img, r)
+	theme = repton.FindDominantColourInCounts(counts, "")
+	if theme != -1 && theme != repton.KC_BLACK {
+		best, first, second := bestTwo(counts[:repton.KC_BLACK])
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		margin := 0.0
+		if best == theme && total != 0 {
+			margin = float64(first-second) / float64(total)
+		}
+		return ThemeDetection{theme, THEME_SELECTER, margin}
+	}
+	return ThemeDetection{-1, THEME_NONE, 0}
+}
@@ -0,0 +1,138 @@
+package edshot
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// ScanLine is a line of pixels which one of the Find functions examined.
+// OK is false if the scan failed to find what it was looking for.
+type ScanLine struct {
+	From image.Point
+	To   image.Point
+	OK   bool
+}
+
+// TracedTile records how a map tile was classified.
+type TracedTile struct {
+	Rect   image.Rectangle
+	Method string
+}
+
+// Trace records what the functions analysing a screenshot found, so that it
+// can be drawn over the screenshot to help diagnose failures. A nil *Trace
+// may be passed to any of the functions which take one; nothing is recorded.
+type Trace struct {
+	SelBounds     image.Rectangle
+	MapBounds     image.Rectangle
+	ThemePixel    image.Point
+	HasThemePixel bool
+	ScanLines     []ScanLine
+	Tiles         []TracedTile
+}
+
+// Colours used by Trace.Draw
+var (
+	TRACE_SELECTER   = color.NRGBA{0, 255, 255, 255}
+	TRACE_MAP        = color.NRGBA{255, 255, 0, 255}
+	TRACE_THEME      = color.NRGBA{255, 0, 255, 255}
+	TRACE_SCAN_OK    = color.NRGBA{0, 255, 0, 255}
+	TRACE_SCAN_FAIL  = color.NRGBA{255, 0, 0, 255}
+	TRACE_TILE_HASH  = color.NRGBA{0, 255, 0, 64}
+	TRACE_TILE_FUZZY = color.NRGBA{255, 192, 0, 96}
+	TRACE_TILE_NONE  = color.NRGBA{255, 0, 0, 128}
+)
+
+func (t *Trace) setSelecters(r image.Rectangle) {
+	if t != nil {
+		t.SelBounds = r
+	}
+}
+
+func (t *Trace) setMap(r image.Rectangle) {
+	if t != nil {
+		t.MapBounds = r
+	}
+}
+
+func (t *Trace) setThemePixel(p image.Point) {
+	if t != nil {
+		t.ThemePixel = p
+		t.HasThemePixel = true
+	}
+}
+
+func (t *Trace) addScanLine(x0, y0, x1, y1 int, ok bool) {
+	if t != nil {
+		t.ScanLines = append(t.ScanLines,
+			ScanLine{image.Point{x0, y0}, image.Point{x1, y1}, ok})
+	}
+}
+
+// AddTile records the classification of the map tile in region r.
+func (t *Trace) AddTile(r image.Rectangle, method string) {
+	if t != nil {
+		t.Tiles = append(t.Tiles, TracedTile{r, method})
+	}
+}
+
+// fill blends a colour over a region of img.
+func fill(img draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+// outline draws a rectangle's outline, thickness pixels wide, just outside r.
+func outline(img draw.Image, r image.Rectangle, c color.Color, thickness int) {
+	o := r.Inset(-thickness)
+	fill(img, image.Rect(o.Min.X, o.Min.Y, o.Max.X, r.Min.Y), c)
+	fill(img, image.Rect(o.Min.X, r.Max.Y, o.Max.X, o.Max.Y), c)
+	fill(img, image.Rect(o.Min.X, r.Min.Y, r.Min.X, r.Max.Y), c)
+	fill(img, image.Rect(r.Max.X, r.Min.Y, o.Max.X, r.Max.Y), c)
+}
+
+// Draw returns a copy of img annotated with everything recorded in the trace:
+// tiles shaded according to how they were classified, the selecter and map
+// regions outlined, the scan lines and the pixel used to detect the theme.
+func (t *Trace) Draw(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+	for _, tile := range t.Tiles {
+		var c color.Color
+		switch tile.Method {
+		case METHOD_HASH:
+			c = TRACE_TILE_HASH
+		case METHOD_NONE:
+			c = TRACE_TILE_NONE
+		default:
+			// Fuzzy, nearest or another inexact TileClassifier
+			c = TRACE_TILE_FUZZY
+		}
+		fill(out, tile.Rect, c)
+	}
+	if !t.SelBounds.Empty() {
+		outline(out, t.SelBounds, TRACE_SELECTER, 2)
+	}
+	if !t.MapBounds.Empty() {
+		outline(out, t.MapBounds, TRACE_MAP, 2)
+	}
+	for _, sl := range t.ScanLines {
+		c := TRACE_SCAN_FAIL
+		if sl.OK {
+			c = TRACE_SCAN_OK
+		}
+		r := image.Rectangle{sl.From, sl.To}.Canon()
+		r.Max = r.Max.Add(image.Point{1, 1})
+		fill(out, r, c)
+	}
+	if t.HasThemePixel {
+		p := t.ThemePixel
+		// A cross hair with a gap so the pixel itself is still visible
+		fill(out, image.Rect(p.X-8, p.Y, p.X-2, p.Y+1), TRACE_THEME)
+		fill(out, image.Rect(p.X+3, p.Y, p.X+9, p.Y+1), TRACE_THEME)
+		fill(out, image.Rect(p.X, p.Y-8, p.X+1, p.Y-2), TRACE_THEME)
+		fill(out, image.Rect(p.X, p.Y+3, p.X+1, p.Y+9), TRACE_THEME)
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+// render draws Repton 2 maps as images using a set of sprites
+package render
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/realh/repmap/pkg/edshot"
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+	"github.com/realh/repmap/pkg/sprites"
+)
+
+const (
+	// Size of tiles in the Repton Resource Page's maps
+	RRP_TILE_WIDTH  = 64
+	RRP_TILE_HEIGHT = 64
+
+	// Size of tiles in the editor's map at its normal size; multiply by the
+	// pixel scale, eg 2 on a hidpi screen, for the size in a screenshot
+	EDITOR_TILE_WIDTH  = edshot.MAP_TILE_WIDTH
+	EDITOR_TILE_HEIGHT = edshot.MAP_TILE_HEIGHT
+)
+
+// MISSING is the colour used to fill tiles which don't have a sprite,
+// including unknown tiles
+var MISSING = color.RGBA{128, 128, 128, 255}
+
+// RenderMap draws m using sprites from the set for the map's theme, scaling
+// each sprite to tileWidth x tileHeight. Tiles with no sprite are filled with
+// MISSING.
+func RenderMap(m *repton2.Map, set sprites.Set, tileWidth, tileHeight int,
+) (*image.RGBA, error) {
+	if set[m.Theme] == nil {
+		return nil, fmt.Errorf("no sprites for theme %s", m.Theme)
+	}
+	img := image.NewRGBA(
+		image.Rect(0, 0, m.Width*tileWidth, m.Height*tileHeight))
+	// Scale each sprite once, on demand
+	scaled := make(map[int]image.Image)
+	missing := image.NewUniform(MISSING)
+	for y := 0; y < m.Height; y++ {
+		for x := 0; x < m.Width; x++ {
+			t := m.At(x, y)
+			if scaled[t] == nil {
+				sprt := set.Get(m.Theme, t)
+				if sprt == nil {
+					scaled[t] = missing
+				} else {
+					scaled[t] = repton.ScaleImage(sprt, nil,
+						tileWidth, tileHeight)
+				}
+			}
+			r := image.Rect(x*tileWidth, y*tileHeight,
+				(x+1)*tileWidth, (y+1)*tileHeight)
+			draw.Draw(img, r, scaled[t], image.Point{}, draw.Src)
+		}
+	}
+	return img, nil
+}
@@ -5,7 +5,6 @@ import (
 	"image"
 	"image/color"
 	"math"
-	"sync"
 
 	"github.com/crazy3lf/colorconv"
 )
@@ -37,6 +36,12 @@ func SqByteDiff(a, b uint32) float64 {
 func ColourMatch(c1, c2 color.Color) float64 {
 	r1, g1, b1, _ := c1.RGBA()
 	r2, g2, b2, _ := c2.RGBA()
+	return ColourMatchRGB(r1, g1, b1, r2, g2, b2)
+}
+
+// ColourMatchRGB is like ColourMatch for colours given as components in the
+// form returned by Color.RGBA.
+func ColourMatchRGB(r1, g1, b1, r2, g2, b2 uint32) float64 {
 	return math.Sqrt(SqByteDiff(r1, r2)*MATCH_WEIGHT_R +
 		SqByteDiff(g1, g2)*MATCH_WEIGHT_G +
 		SqByteDiff(b1, b2)*MATCH_WEIGHT_B)
@@ -91,15 +96,26 @@ func DetectColourTheme(c color.Color) int {
 	return -1
 }
 
+// CountEachColourInImageInBounds counts how many pixels in bounds match each
+// of the key colours according to DetectColourTheme.
 func CountEachColourInImageInBounds(
 	img image.Image,
 	bounds image.Rectangle,
 ) [7]int {
 	var counts [7]int
+	pixels := NewPixelReader(img)
+	// Screenshots have few distinct colours, so remember what each one was
+	themes := make(map[[4]uint32]int)
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			pixel := img.At(x, y)
-			colour := DetectColourTheme(pixel)
+			r, g, b, a := pixels.RGBA(x, y)
+			key := [4]uint32{r, g, b, a}
+			colour, ok := themes[key]
+			if !ok {
+				colour = DetectColourTheme(color.RGBA64{
+					uint16(r), uint16(g), uint16(b), uint16(a)})
+				themes[key] = colour
+			}
 			if colour != -1 {
 				counts[colour]++
 			}
@@ -161,64 +177,27 @@ func FindDominantColourInCounts(
 // into whichever of the above colours they match best. It returns the index
 // of the colour with the most matches.
 func DetectThemeOfEntireImage(img image.Image, description string) int {
-	numGoroutines := 4
-	bounds := img.Bounds()
-	//fmt.Printf("DetectThemeOfEntireImage: bounds %v\n", bounds)
-	height := bounds.Max.Y - bounds.Min.Y
-	rowsPerGoroutine := height / numGoroutines
-	var counts [7]int
-	// Each colour has its own counter goroutine
-	var counterChannels [7]chan int
-	for i := range counterChannels {
-		counterChannels[i] = make(chan int, numGoroutines)
-	}
-	// Counters stop when this channel closes
-	scannersDoneChannel := make(chan bool)
-	// Pixel scanner goroutines use a WaitGroup to signal the other goroutines
-	// that they've finished
-	wg := &sync.WaitGroup{}
-
-	// Start 4 goroutines to scan pixels
-	for gr := 0; gr < numGoroutines; gr++ {
-		wg.Add(1)
-		go func(portion int) {
-			y0 := portion * rowsPerGoroutine
-			y1 := min(y0+rowsPerGoroutine, height)
-			//fmt.Printf("Thread %d processing rows %d-%d\n", portion, y0, y1)
-			subBounds := image.Rect(bounds.Min.X, y0, bounds.Max.X, y1)
-			portionCounts := CountEachColourInImageInBounds(img, subBounds)
-			for colour, count := range portionCounts {
-				counterChannels[colour] <- count
-			}
-			wg.Done()
-		}(gr)
-	}
+	return FindDominantColourInCounts(
+		CountEachColourInRegion(img, img.Bounds()), description)
+}
 
-	// This goroutine waits for all the pixel scanner goroutines to finish
-	// (using the WaitGroup) then closes scannersDoneChannel which signals
-	// the following counter goroutines to stop
-	go func() {
-		wg.Wait()
-		close(scannersDoneChannel)
-	}()
-
-	// Use another WaitGroup for the counter goroutines
-	wg2 := sync.WaitGroup{}
-	for i := 0; i < 6; i++ {
-		wg2.Add(1)
-		go func(colourIndex int) {
-			for counting := true; counting; {
-				select {
-				case n := <-counterChannels[colourIndex]:
-					counts[colourIndex] += n
-				case <-scannersDoneChannel:
-					counting = false
-				}
-			}
-			wg2.Done()
-			close(counterChannels[colourIndex])
-		}(i)
+// CountEachColourInRegion is like CountEachColourInImageInBounds, but shares
+// the work between several goroutines. Black pixels aren't counted.
+func CountEachColourInRegion(img image.Image, bounds image.Rectangle) [7]int {
+	numPortions := 4
+	height := bounds.Dy()
+	portionCounts := make([][7]int, numPortions)
+	ForEachParallel(numPortions, func(portion int) {
+		y0 := bounds.Min.Y + portion*height/numPortions
+		y1 := bounds.Min.Y + (portion+1)*height/numPortions
+		portionCounts[portion] = CountEachColourInImageInBounds(img,
+			image.Rect(bounds.Min.X, y0, bounds.Max.X, y1))
+	})
+	var counts [7]int
+	for _, pc := range portionCounts {
+		for colour := 0; colour < KC_BLACK; colour++ {
+			counts[colour] += pc[colour]
+		}
 	}
-	wg2.Wait()
-	return FindDominantColourInCounts(counts, description)
+	return counts
 }
@@ -1,11 +1,13 @@
 package repton
 
 import (
+	"bytes"
 	"fmt"
 	"image"
-	"image/color"
 	"image/png"
+	"io"
 	"os"
+	"path/filepath"
 )
 
 func RectsAreSameSize(r1, r2 *image.Rectangle) bool {
@@ -59,6 +61,9 @@ func ImagesAreEqualVerbose(img1 image.Image, region1 *image.Rectangle,
 	if width != region2.Dx() { return false }
 	height := region1.Dy()
 	if height != region2.Dy() { return false }
+	if !verbose {
+		return pixelsAreEqual(img1, *region1, img2, *region2)
+	}
 	for y := 0; y < height; y++ {
 		y1 := region1.Min.Y + y
 		y2 := region2.Min.Y + y
@@ -79,6 +84,38 @@ func ImagesAreEqualVerbose(img1 image.Image, region1 *image.Rectangle,
 	return true
 }
 
+// pixelsAreEqual is the non-verbose part of ImagesAreEqualVerbose. The regions
+// must be the same size.
+func pixelsAreEqual(img1 image.Image, region1 image.Rectangle,
+	img2 image.Image, region2 image.Rectangle,
+) bool {
+	rgba1, ok1 := img1.(*image.RGBA)
+	rgba2, ok2 := img2.(*image.RGBA)
+	if ok1 && ok2 && region1.In(rgba1.Rect) && region2.In(rgba2.Rect) {
+		n := region1.Dx() * 4
+		for y := 0; y < region1.Dy(); y++ {
+			i1 := rgba1.PixOffset(region1.Min.X, region1.Min.Y+y)
+			i2 := rgba2.PixOffset(region2.Min.X, region2.Min.Y+y)
+			if !bytes.Equal(rgba1.Pix[i1:i1+n], rgba2.Pix[i2:i2+n]) {
+				return false
+			}
+		}
+		return true
+	}
+	pixels1 := NewPixelReader(img1)
+	pixels2 := NewPixelReader(img2)
+	for y := 0; y < region1.Dy(); y++ {
+		y1 := region1.Min.Y + y
+		y2 := region2.Min.Y + y
+		for x := 0; x < region1.Dx(); x++ {
+			r1, g1, b1, a1 := pixels1.RGBA(region1.Min.X+x, y1)
+			r2, g2, b2, a2 := pixels2.RGBA(region2.Min.X+x, y2)
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 { return false }
+		}
+	}
+	return true
+}
+
 func ImagesAreEqual(img1 image.Image, region1 *image.Rectangle,
 	img2 image.Image, region2 *image.Rectangle,
 ) bool {
@@ -110,8 +147,8 @@ func CopyRegion(dest *image.RGBA, destRegion *image.Rectangle,
 	}
 	b := dest.Bounds()
 	if destRegion == nil {
-		r := image.Rect(b.Min.X, b.Min.X + srcRegion.Dx(),
-			b.Min.Y, b.Min.Y + srcRegion.Dy())
+		r := image.Rect(b.Min.X, b.Min.Y,
+			b.Min.X + srcRegion.Dx(), b.Min.Y + srcRegion.Dy())
 		destRegion = &r
 	}
 	if destRegion.Max.X > b.Max.X {
@@ -129,19 +166,24 @@ func CopyRegion(dest *image.RGBA, destRegion *image.Rectangle,
 	
 	width := destRegion.Dx()
 	height := destRegion.Dy()
+	srcRGBA, isRGBA := src.(*image.RGBA)
+	isRGBA = isRGBA && image.Rect(srcRegion.Min.X, srcRegion.Min.Y,
+		srcRegion.Min.X + width, srcRegion.Min.Y + height).In(srcRGBA.Rect)
+	pixels := NewPixelReader(src)
 	for y := 0; y < height; y++ {
 		y1 := destRegion.Min.Y + y
 		y2 := srcRegion.Min.Y + y
+		i := dest.PixOffset(destRegion.Min.X, y1)
+		row := dest.Pix[i : i + width * 4]
+		if isRGBA {
+			// Both the same format, so copy the whole row
+			j := srcRGBA.PixOffset(srcRegion.Min.X, y2)
+			copy(row, srcRGBA.Pix[j : j + width * 4])
+			continue
+		}
 		for x := 0; x < width; x++ {
-			x1 := destRegion.Min.X + x
-			x2 := srcRegion.Min.X + x
-			r, g, b, a := src.At(x2, y2).RGBA()
-			dest.SetRGBA(x1, y1, color.RGBA{
-				R: uint8(r >> 8),
-				G: uint8(g >> 8),
-				B: uint8(b >> 8),
-				A: uint8(a >> 8),
-			})
+			row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] =
+				pixels.RGBA8(srcRegion.Min.X + x, y2)
 		}
 	}
 }
@@ -160,3 +202,56 @@ func SavePNG(img image.Image, fileName string) error {
 	}
 	return err
 }
+
+// ScaleImage makes a new image of size width x height from a region of src
+// using nearest-neighbour sampling. If region is nil the whole of src is used.
+// Each destination pixel takes the source pixel under its centre, so that the
+// scale needn't be a whole number.
+func ScaleImage(src image.Image, region *image.Rectangle,
+	width, height int,
+) *image.RGBA {
+	if region == nil {
+		r := src.Bounds()
+		region = &r
+	}
+	dest := image.NewRGBA(image.Rect(0, 0, width, height))
+	pixels := NewPixelReader(src)
+	sw := region.Dx()
+	sh := region.Dy()
+	for y := 0; y < height; y++ {
+		sy := region.Min.Y + (2*y+1)*sh/(2*height)
+		row := dest.Pix[y*dest.Stride:]
+		for x := 0; x < width; x++ {
+			sx := region.Min.X + (2*x+1)*sw/(2*width)
+			row[x*4], row[x*4+1], row[x*4+2], row[x*4+3] =
+				pixels.RGBA8(sx, sy)
+		}
+	}
+	return dest
+}
+
+// WriteFileAtomic creates a file by filling a temporary file in the same
+// folder using write, then renaming it, so that a half-written file is never
+// left behind, and an existing file is left alone, if writing fails or the
+// program is interrupted.
+func WriteFileAtomic(filename string, write func(io.Writer) error) error {
+	fd, err := os.CreateTemp(filepath.Dir(filename),
+		"."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = write(fd)
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(fd.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
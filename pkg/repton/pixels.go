@@ -0,0 +1,115 @@
+package repton
+
+import (
+	"image"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// PixelReader reads pixels from an image without allocating a color.Color for
+// each one as image.Image.At does. It reads the Pix slice of *image.RGBA,
+// *image.NRGBA and *image.Paletted directly, which covers everything the png
+// package decodes screenshots to; other types fall back to At.
+type PixelReader struct {
+	img      image.Image
+	rgba     *image.RGBA
+	nrgba    *image.NRGBA
+	paletted *image.Paletted
+	palette  [][4]uint32
+}
+
+// NewPixelReader creates a PixelReader for img.
+func NewPixelReader(img image.Image) *PixelReader {
+	p := &PixelReader{img: img}
+	switch img := img.(type) {
+	case *image.RGBA:
+		p.rgba = img
+	case *image.NRGBA:
+		p.nrgba = img
+	case *image.Paletted:
+		p.paletted = img
+		p.palette = make([][4]uint32, len(img.Palette))
+		for i, c := range img.Palette {
+			r, g, b, a := c.RGBA()
+			p.palette[i] = [4]uint32{r, g, b, a}
+		}
+	}
+	return p
+}
+
+// RGBA returns the same as img.At(x, y).RGBA().
+func (p *PixelReader) RGBA(x, y int) (r, g, b, a uint32) {
+	switch {
+	case p.rgba != nil:
+		if !(image.Point{x, y}.In(p.rgba.Rect)) {
+			return
+		}
+		i := p.rgba.PixOffset(x, y)
+		s := p.rgba.Pix[i : i+4 : i+4]
+		return uint32(s[0]) * 0x101, uint32(s[1]) * 0x101,
+			uint32(s[2]) * 0x101, uint32(s[3]) * 0x101
+	case p.nrgba != nil:
+		if !(image.Point{x, y}.In(p.nrgba.Rect)) {
+			return
+		}
+		i := p.nrgba.PixOffset(x, y)
+		s := p.nrgba.Pix[i : i+4 : i+4]
+		// Premultiply the same way as color.NRGBA.RGBA
+		a = uint32(s[3])
+		r = uint32(s[0]) * 0x101 * a / 0xff
+		g = uint32(s[1]) * 0x101 * a / 0xff
+		b = uint32(s[2]) * 0x101 * a / 0xff
+		return r, g, b, a * 0x101
+	case p.paletted != nil:
+		if len(p.palette) == 0 {
+			return
+		}
+		var c [4]uint32
+		if (image.Point{x, y}.In(p.paletted.Rect)) {
+			if i := int(p.paletted.Pix[p.paletted.PixOffset(x, y)]); i <
+				len(p.palette) {
+				c = p.palette[i]
+			}
+		} else {
+			c = p.palette[0]
+		}
+		return c[0], c[1], c[2], c[3]
+	}
+	return p.img.At(x, y).RGBA()
+}
+
+// RGBA8 returns the top 8 bits of each of the components returned by RGBA.
+func (p *PixelReader) RGBA8(x, y int) (r, g, b, a uint8) {
+	if p.rgba != nil && (image.Point{x, y}.In(p.rgba.Rect)) {
+		i := p.rgba.PixOffset(x, y)
+		s := p.rgba.Pix[i : i+4 : i+4]
+		return s[0], s[1], s[2], s[3]
+	}
+	r16, g16, b16, a16 := p.RGBA(x, y)
+	return uint8(r16 >> 8), uint8(g16 >> 8), uint8(b16 >> 8), uint8(a16 >> 8)
+}
+
+// ForEachParallel calls f(i) for each i from 0 to n-1, sharing the calls
+// between a pool of goroutines, one per CPU, and waits for them to finish.
+func ForEachParallel(n int, f func(i int)) {
+	workers := min(runtime.GOMAXPROCS(0), n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var next atomic.Int64
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
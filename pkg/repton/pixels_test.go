@@ -0,0 +1,103 @@
+package repton
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+// atOnly hides the concrete type of an image so that it's read with At.
+type atOnly struct {
+	image.Image
+}
+
+// testPalette has the key colours plus grey and white, like a screenshot.
+var testPalette = color.Palette{
+	color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255},
+	color.RGBA{0, 0, 255, 255}, color.RGBA{0, 255, 255, 255},
+	color.RGBA{255, 0, 255, 255}, color.RGBA{255, 255, 0, 255},
+	color.RGBA{255, 128, 0, 255}, color.RGBA{0, 0, 0, 255},
+	color.RGBA{192, 192, 192, 255}, color.RGBA{255, 255, 255, 255},
+}
+
+// testImages returns the same image of random palette colours as each of the
+// formats PixelReader reads directly, plus one which has to be read with At.
+func testImages(w, h int) []struct {
+	name string
+	img  image.Image
+} {
+	rng := rand.New(rand.NewSource(1))
+	r := image.Rect(0, 0, w, h)
+	paletted := image.NewPaletted(r, testPalette)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rng.Intn(len(testPalette)))
+	}
+	rgba := image.NewRGBA(r)
+	draw.Draw(rgba, r, paletted, image.Point{}, draw.Src)
+	nrgba := image.NewNRGBA(r)
+	draw.Draw(nrgba, r, paletted, image.Point{}, draw.Src)
+	return []struct {
+		name string
+		img  image.Image
+	}{
+		{"RGBA", rgba},
+		{"NRGBA", nrgba},
+		{"Paletted", paletted},
+		{"At", atOnly{rgba}},
+	}
+}
+
+func TestPixelReader(t *testing.T) {
+	for _, ti := range testImages(20, 10) {
+		pixels := NewPixelReader(ti.img)
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 20; x++ {
+				r1, g1, b1, a1 := ti.img.At(x, y).RGBA()
+				r2, g2, b2, a2 := pixels.RGBA(x, y)
+				if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+					t.Fatalf("%s pixel %d,%d is %v, expected %v", ti.name,
+						x, y, [4]uint32{r2, g2, b2, a2},
+						[4]uint32{r1, g1, b1, a1})
+				}
+			}
+		}
+	}
+}
+
+// Benchmark images are the size of the map in a 2x screenshot.
+const benchWidth, benchHeight = 1024, 960
+
+func BenchmarkCountEachColourInRegion(b *testing.B) {
+	for _, ti := range testImages(benchWidth, benchHeight) {
+		b.Run(ti.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				CountEachColourInRegion(ti.img, ti.img.Bounds())
+			}
+		})
+	}
+}
+
+func BenchmarkImagesAreEqualVerbose(b *testing.B) {
+	for _, ti := range testImages(benchWidth, benchHeight) {
+		b.Run(ti.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if !ImagesAreEqualVerbose(ti.img, nil, ti.img, nil, false) {
+					b.Fatal("image differs from itself")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCopyRegion(b *testing.B) {
+	for _, ti := range testImages(benchWidth, benchHeight) {
+		b.Run(ti.name, func(b *testing.B) {
+			dest := image.NewRGBA(ti.img.Bounds())
+			for i := 0; i < b.N; i++ {
+				CopyRegion(dest, nil, ti.img, nil)
+			}
+		})
+	}
+}
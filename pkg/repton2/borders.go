@@ -0,0 +1,98 @@
+package repton2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SkyType is the Top field of Borders.csv; what's shown above the map
+type SkyType int
+
+const (
+	SKY_UNDERGROUND SkyType = iota
+	SKY_SURFACE
+	SKY_METEORS
+)
+
+// SkyNames are the names of the SkyTypes as they appear in Borders.csv
+var SkyNames = [...]string{"Underground", "Surface", "Meteors"}
+
+func (st SkyType) String() string {
+	if st < 0 || int(st) >= len(SkyNames) {
+		return fmt.Sprintf("SkyType(%d)", int(st))
+	}
+	return SkyNames[st]
+}
+
+// MapAccess is the Map field of Borders.csv; whether the player can view the
+// map of the level
+type MapAccess int
+
+const (
+	MAP_VIEWABLE MapAccess = iota
+	MAP_VISITED
+	MAP_NO
+)
+
+// MapAccessNames are the names of the MapAccess values as they appear in
+// Borders.csv
+var MapAccessNames = [...]string{"Viewable", "Visited", "No"}
+
+func (ma MapAccess) String() string {
+	if ma < 0 || int(ma) >= len(MapAccessNames) {
+		return fmt.Sprintf("MapAccess(%d)", int(ma))
+	}
+	return MapAccessNames[ma]
+}
+
+// Border holds one line of Borders.csv. Tile is the tile which surrounds the
+// map; in the file it's a Repton Map Decoder code.
+type Border struct {
+	Top  SkyType
+	Map  MapAccess
+	Tile int
+}
+
+func parseName(s string, names []string, what string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("invalid %s '%s', expected one of %s",
+		what, s, strings.Join(names, ", "))
+}
+
+// ParseBorder parses a line from Borders.csv in the format Top,Map,Tile. On
+// error the result is a zero Border.
+func ParseBorder(line string) (Border, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) != 3 {
+		return Border{}, fmt.Errorf("expected 3 fields, found %d", len(fields))
+	}
+	top, err := parseName(strings.TrimSpace(fields[0]), SkyNames[:], "Top")
+	if err != nil {
+		return Border{}, err
+	}
+	ma, err := parseName(strings.TrimSpace(fields[1]),
+		MapAccessNames[:], "Map")
+	if err != nil {
+		return Border{}, err
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(fields[2]))
+	if err != nil {
+		return Border{}, fmt.Errorf("can't parse Tile '%s' as number",
+			fields[2])
+	}
+	tile, ok := TileByRMDCode(code)
+	if !ok {
+		return Border{}, fmt.Errorf("unknown Tile code %d", code)
+	}
+	return Border{SkyType(top), MapAccess(ma), tile}, nil
+}
+
+// String returns the border in the format read by ParseBorder.
+func (b Border) String() string {
+	return fmt.Sprintf("%s,%s,%d", b.Top, b.Map, TileInfos[b.Tile].RMDCode)
+}
@@ -0,0 +1,22 @@
+package repton2
+
+import "testing"
+
+func TestBorderNames(t *testing.T) {
+	tests := []struct {
+		v        interface{ String() string }
+		expected string
+	}{
+		{SKY_METEORS, "Meteors"},
+		{SkyType(3), "SkyType(3)"},
+		{SkyType(-1), "SkyType(-1)"},
+		{MAP_NO, "No"},
+		{MapAccess(7), "MapAccess(7)"},
+		{MapAccess(-2), "MapAccess(-2)"},
+	}
+	for _, test := range tests {
+		if s := test.v.String(); s != test.expected {
+			t.Errorf("got '%s', expected '%s'", s, test.expected)
+		}
+	}
+}
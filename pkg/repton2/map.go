@@ -0,0 +1,170 @@
+package repton2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/realh/repmap/pkg/repton"
+)
+
+// Map holds the tiles of one level along with its colour theme. Tiles are
+// stored row by row, so the tile at (x, y) is Tiles[y*Width+x].
+type Map struct {
+	Theme  string
+	Width  int
+	Height int
+	Tiles  []int
+}
+
+// ParseError describes a problem found while parsing a text file. Line and
+// Column are 1-based; Column is 0 if the error applies to the whole line.
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+// NewMap creates a map of the given size filled with blanks.
+func NewMap(theme string, width, height int) *Map {
+	return &Map{
+		Theme:  theme,
+		Width:  width,
+		Height: height,
+		Tiles:  make([]int, width*height),
+	}
+}
+
+// ParseTheme returns the canonical name of a colour theme, eg "Blue", given
+// a name in any case. Black is not a valid theme.
+func ParseTheme(name string) (string, error) {
+	for _, theme := range repton.ColourNames[:repton.KC_BLACK] {
+		if strings.EqualFold(name, theme) {
+			return theme, nil
+		}
+	}
+	return "", fmt.Errorf("unknown colour theme '%s'", name)
+}
+
+// At returns the tile at (x, y).
+func (m *Map) At(x, y int) int {
+	return m.Tiles[y*m.Width+x]
+}
+
+// Set changes the tile at (x, y).
+func (m *Map) Set(x, y, t int) {
+	m.Tiles[y*m.Width+x] = t
+}
+
+// Row returns the ASCII representation of row y.
+func (m *Map) Row(y int) string {
+	row := make([]byte, m.Width)
+	for x := range row {
+		row[x] = TileChar(m.At(x, y))
+	}
+	return string(row)
+}
+
+// ParseRow converts a line of ASCII map data to tile types. lineNum is only
+// used for error reporting.
+func ParseRow(line string, lineNum int) ([]int, error) {
+	row := make([]int, len(line))
+	for i := 0; i < len(line); i++ {
+		t, ok := CharTile(line[i])
+		if !ok {
+			return nil, &ParseError{lineNum, i + 1,
+				fmt.Sprintf("invalid tile character %q", line[i])}
+		}
+		row[i] = t
+	}
+	return row, nil
+}
+
+// ReadASCII reads a map in the format output by img2map: the first line is
+// the colour theme and each following line is a row of tiles, one character
+// per tile. Reading stops at the first blank line or EOF; only blank lines may
+// follow.
+func ReadASCII(r io.Reader) (*Map, error) {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	m := &Map{}
+	blank := false
+	for scanner.Scan() {
+		lineNum++
+		// In case of DOS line endings
+		line := strings.TrimSpace(scanner.Text())
+		if lineNum == 1 {
+			theme, err := ParseTheme(line)
+			if err != nil {
+				return nil, &ParseError{lineNum, 0, err.Error()}
+			}
+			m.Theme = theme
+			continue
+		}
+		if len(line) == 0 {
+			blank = true
+			continue
+		} else if blank {
+			return nil, &ParseError{lineNum, 0, "map data after blank line"}
+		}
+		if m.Height != 0 && len(line) != m.Width {
+			return nil, &ParseError{lineNum, 0, fmt.Sprintf(
+				"row has %d tiles, expected %d", len(line), m.Width)}
+		}
+		row, err := ParseRow(line, lineNum)
+		if err != nil {
+			return nil, err
+		}
+		m.Width = len(row)
+		m.Tiles = append(m.Tiles, row...)
+		m.Height++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lineNum == 0 {
+		return nil, &ParseError{1, 0, "missing colour theme"}
+	}
+	if m.Height == 0 {
+		return nil, &ParseError{lineNum, 0, "no map data"}
+	}
+	return m, nil
+}
+
+// WriteASCII writes the map in the same format read by ReadASCII.
+func (m *Map) WriteASCII(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, m.Theme)
+	for y := 0; y < m.Height; y++ {
+		fmt.Fprintln(bw, m.Row(y))
+	}
+	return bw.Flush()
+}
+
+// LoadASCII loads a map from a file in the format read by ReadASCII.
+func LoadASCII(filename string) (*Map, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open '%s': %v", filename, err)
+	}
+	defer fd.Close()
+	m, err := ReadASCII(fd)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", filename, err)
+	}
+	return m, nil
+}
+
+// SaveASCII saves the map to a file in the format read by ReadASCII.
+func (m *Map) SaveASCII(filename string) error {
+	return writeFile(filename, m.WriteASCII)
+}
@@ -0,0 +1,71 @@
+package repton2
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadASCII(t *testing.T) {
+	m, err := ReadASCII(strings.NewReader("blue\r\n.1U\r\nO?W\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Theme != "Blue" || m.Width != 3 || m.Height != 2 {
+		t.Fatalf("got %s %d x %d, expected Blue 3 x 2",
+			m.Theme, m.Width, m.Height)
+	}
+	expected := []int{T_BLANK, T_DIAMOND, T_PUZZLE,
+		T_TRANSPORTER, T_UNKNOWN, T_BRICK_GROUND}
+	for i, tile := range expected {
+		if m.Tiles[i] != tile {
+			t.Errorf("tile %d is %s, expected %s", i,
+				TileName(m.Tiles[i]), TileName(tile))
+		}
+	}
+}
+
+func TestReadASCIIErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		line   int
+		column int
+	}{
+		{"bad character", "Green\n...\n.#.\n", 3, 2},
+		{"ragged row", "Green\n...\n..\n", 3, 0},
+		{"unknown theme", "Purple\n...\n", 1, 0},
+		{"black theme", "Black\n...\n", 1, 0},
+		{"data after blank line", "Green\n...\n\n...\n", 4, 0},
+		{"missing theme", "", 1, 0},
+		{"no map data", "Green\n", 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadASCII(strings.NewReader(test.input))
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if pe.Line != test.line || pe.Column != test.column {
+				t.Errorf("error at line %d column %d, expected %d, %d: %v",
+					pe.Line, pe.Column, test.line, test.column, err)
+			}
+		})
+	}
+}
+
+func TestWriteASCII(t *testing.T) {
+	const text = "Red\n.1U\nO?W\n"
+	m, err := ReadASCII(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if err := m.WriteASCII(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != text {
+		t.Errorf("wrote %q, expected %q", sb.String(), text)
+	}
+}
@@ -0,0 +1,608 @@
+package repton2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	N_LEVELS = 20 // Number of levels in a scenario
+
+	// Default size of the puzzle in pieces
+	PUZZLE_WIDTH  = 13
+	PUZZLE_HEIGHT = 8
+)
+
+// PosKey encodes a map level number and x, y coords in a single int
+type PosKey int
+
+// NewPosKey creates a new PosKey from the given level and position
+func NewPosKey(level, x, y int) PosKey {
+	return PosKey((level << 16) | (x << 8) | y)
+}
+
+// Decode returns the individual components of a PosKey
+func (pk PosKey) Decode() (level, x, y int) {
+	i := int(pk)
+	level = i >> 16
+	x = (i >> 8) & 0xff
+	y = i & 0xff
+	return
+}
+
+func (pk PosKey) String() string {
+	l, x, y := pk.Decode()
+	return fmt.Sprintf("%d,%d,%d", l, x, y)
+}
+
+// Level is one level of a scenario. Border is parsed from the level's line in
+// Borders.csv, and BorderText is that line as read, so that it can be written
+// back out unchanged.
+type Level struct {
+	Border     Border
+	BorderText string
+	*Map
+}
+
+// BorderLine returns the level's line for Borders.csv: BorderText if set,
+// otherwise Border in its canonical format.
+func (l *Level) BorderLine() string {
+	if l.BorderText != "" {
+		return l.BorderText
+	}
+	return l.Border.String()
+}
+
+// Transporter links a transporter tile to the position Repton arrives at.
+type Transporter struct {
+	Src  PosKey
+	Dest PosKey
+}
+
+// Puzzle holds the size of the puzzle picture in pieces and the location of
+// each piece, in the order they appear in the picture. PieceText holds the
+// pieces' lines as read, including any which couldn't be parsed, so that they
+// can be written back out unchanged.
+type Puzzle struct {
+	Width     int
+	Height    int
+	Pieces    []PosKey
+	PieceText []string
+}
+
+// PieceLines returns the puzzle's piece lines: PieceText if set, otherwise
+// Pieces in their canonical format.
+func (p *Puzzle) PieceLines() []string {
+	if p.PieceText != nil {
+		return p.PieceText
+	}
+	lines := make([]string, len(p.Pieces))
+	for i, pk := range p.Pieces {
+		lines[i] = pk.String()
+	}
+	return lines
+}
+
+// Scenario holds everything needed to describe a complete scenario. Level n
+// is Levels[n-1]. TransporterText holds the transporter lines as read,
+// including any which couldn't be parsed, so that they can be written back
+// out unchanged. LoadProblems lists problems found by LoadScenarioDir which
+// didn't stop it loading the scenario; Validate includes them in its result.
+type Scenario struct {
+	Levels          [N_LEVELS]Level
+	Transporters    []Transporter
+	TransporterText []string
+	Puzzle          Puzzle
+	LoadProblems    []Problem
+}
+
+// TransporterLines returns the scenario's transporter lines: TransporterText
+// if set, otherwise Transporters in their canonical format.
+func (s *Scenario) TransporterLines() []string {
+	if s.TransporterText != nil {
+		return s.TransporterText
+	}
+	lines := make([]string, len(s.Transporters))
+	for i, tp := range s.Transporters {
+		lines[i] = fmt.Sprintf("%s,%s", tp.Src, tp.Dest)
+	}
+	return lines
+}
+
+// lineReader reads trimmed lines and keeps count of them for error reporting.
+type lineReader struct {
+	scanner *bufio.Scanner
+	lineNum int
+}
+
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{scanner: bufio.NewScanner(r)}
+}
+
+// next returns the next line, or an error at EOF.
+func (lr *lineReader) next() (string, error) {
+	if !lr.scanner.Scan() {
+		if err := lr.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", &ParseError{lr.lineNum + 1, 0, "unexpected end of file"}
+	}
+	lr.lineNum++
+	// In case of DOS line endings
+	return strings.TrimSpace(lr.scanner.Text()), nil
+}
+
+// nonBlank returns the lines up to the first blank line or EOF.
+func (lr *lineReader) nonBlank() ([]string, error) {
+	var lines []string
+	for lr.scanner.Scan() {
+		lr.lineNum++
+		line := strings.TrimSpace(lr.scanner.Text())
+		if len(line) == 0 {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return lines, lr.scanner.Err()
+}
+
+// errorf returns a ParseError for the current line.
+func (lr *lineReader) errorf(format string, args ...any) error {
+	return &ParseError{lr.lineNum, 0, fmt.Sprintf(format, args...)}
+}
+
+// expect reads a line and returns an error if it isn't s.
+func (lr *lineReader) expect(s string) error {
+	line, err := lr.next()
+	if err != nil {
+		return err
+	}
+	if line != s {
+		return lr.errorf("expected '%s', found '%s'", s, line)
+	}
+	return nil
+}
+
+// parseInts parses a line of n comma-separated integers.
+func parseInts(line string, n int, lineNum int) ([]int, error) {
+	fields := strings.Split(line, ",")
+	if len(fields) != n {
+		return nil, &ParseError{lineNum, 0,
+			fmt.Sprintf("expected %d fields, found %d", n, len(fields))}
+	}
+	vals := make([]int, n)
+	for i, f := range fields {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, &ParseError{lineNum, 0,
+				fmt.Sprintf("can't parse field %d '%s' as number", i+1, f)}
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func parseTransporter(line string, lineNum int) (Transporter, error) {
+	v, err := parseInts(line, 6, lineNum)
+	if err != nil {
+		return Transporter{}, err
+	}
+	return Transporter{NewPosKey(v[0], v[1], v[2]),
+		NewPosKey(v[3], v[4], v[5])}, nil
+}
+
+func parsePiece(line string, lineNum int) (PosKey, error) {
+	v, err := parseInts(line, 3, lineNum)
+	if err != nil {
+		return 0, err
+	}
+	return NewPosKey(v[0], v[1], v[2]), nil
+}
+
+// ReadBundle reads a scenario in the combined format written by mkscenario.
+// Each level consists of its two digit number, its Borders.csv line, its
+// colour theme in lower case, its width and height, and its rows, followed by
+// "-", or "--" for the final level. Then there is a "Transporters: n" line
+// followed by n transporters and "--", and finally a "Puzzle: w,h" line
+// followed by w*h pieces and "--". The transporter and piece lines are kept
+// in TransporterText and PieceText.
+func ReadBundle(r io.Reader) (*Scenario, error) {
+	s := &Scenario{}
+	lr := newLineReader(r)
+	for n := 1; n <= N_LEVELS; n++ {
+		if err := lr.expect(fmt.Sprintf("%02d", n)); err != nil {
+			return nil, err
+		}
+		lvl := &s.Levels[n-1]
+		line, err := lr.next()
+		if err != nil {
+			return nil, err
+		}
+		if lvl.Border, err = ParseBorder(line); err != nil {
+			return nil, lr.errorf("level %d border: %v", n, err)
+		}
+		lvl.BorderText = line
+		if line, err = lr.next(); err != nil {
+			return nil, err
+		}
+		theme, err := ParseTheme(line)
+		if err != nil {
+			return nil, lr.errorf("%v", err)
+		}
+		if line, err = lr.next(); err != nil {
+			return nil, err
+		}
+		size, err := parseInts(line, 2, lr.lineNum)
+		if err != nil {
+			return nil, err
+		}
+		lvl.Map = NewMap(theme, size[0], size[1])
+		for y := 0; y < lvl.Height; y++ {
+			if line, err = lr.next(); err != nil {
+				return nil, err
+			}
+			if len(line) != lvl.Width {
+				return nil, lr.errorf("row has %d tiles, expected %d",
+					len(line), lvl.Width)
+			}
+			row, err := ParseRow(line, lr.lineNum)
+			if err != nil {
+				return nil, err
+			}
+			copy(lvl.Tiles[y*lvl.Width:], row)
+		}
+		terminator := "-"
+		if n == N_LEVELS {
+			terminator = "--"
+		}
+		if err := lr.expect(terminator); err != nil {
+			return nil, err
+		}
+	}
+
+	line, err := lr.next()
+	if err != nil {
+		return nil, err
+	}
+	var count int
+	if _, err := fmt.Sscanf(line, "Transporters: %d", &count); err != nil {
+		return nil, lr.errorf("expected 'Transporters: n', found '%s'", line)
+	}
+	for n := 0; n < count; n++ {
+		if line, err = lr.next(); err != nil {
+			return nil, err
+		}
+		tp, err := parseTransporter(line, lr.lineNum)
+		if err != nil {
+			return nil, err
+		}
+		s.Transporters = append(s.Transporters, tp)
+		s.TransporterText = append(s.TransporterText, line)
+	}
+	if err := lr.expect("--"); err != nil {
+		return nil, err
+	}
+
+	if line, err = lr.next(); err != nil {
+		return nil, err
+	}
+	pz := &s.Puzzle
+	if _, err := fmt.Sscanf(line, "Puzzle: %d,%d",
+		&pz.Width, &pz.Height); err != nil {
+		return nil, lr.errorf("expected 'Puzzle: w,h', found '%s'", line)
+	}
+	for n := 0; n < pz.Width*pz.Height; n++ {
+		if line, err = lr.next(); err != nil {
+			return nil, err
+		}
+		pk, err := parsePiece(line, lr.lineNum)
+		if err != nil {
+			return nil, err
+		}
+		pz.Pieces = append(pz.Pieces, pk)
+		pz.PieceText = append(pz.PieceText, line)
+	}
+	if err := lr.expect("--"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// WriteBundle writes the scenario in the format read by ReadBundle.
+func (s *Scenario) WriteBundle(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for n := 1; n <= N_LEVELS; n++ {
+		lvl := &s.Levels[n-1]
+		fmt.Fprintf(bw, "%02d\n", n)
+		fmt.Fprintln(bw, lvl.BorderLine())
+		fmt.Fprintln(bw, strings.ToLower(lvl.Theme))
+		fmt.Fprintf(bw, "%d,%d\n", lvl.Width, lvl.Height)
+		for y := 0; y < lvl.Height; y++ {
+			fmt.Fprintln(bw, lvl.Row(y))
+		}
+		// Terminate with one dash for most levels, two dashes for final level
+		if n == N_LEVELS {
+			fmt.Fprintln(bw, "--")
+		} else {
+			fmt.Fprintln(bw, "-")
+		}
+	}
+	transporters := s.TransporterLines()
+	fmt.Fprintf(bw, "Transporters: %d\n", len(transporters))
+	for _, line := range transporters {
+		fmt.Fprintln(bw, line)
+	}
+	fmt.Fprintln(bw, "--")
+	fmt.Fprintf(bw, "Puzzle: %d,%d\n", s.Puzzle.Width, s.Puzzle.Height)
+	for _, line := range s.Puzzle.PieceLines() {
+		fmt.Fprintln(bw, line)
+	}
+	fmt.Fprintln(bw, "--")
+	return bw.Flush()
+}
+
+// LoadBundle loads a scenario from a file in the format read by ReadBundle.
+func LoadBundle(filename string) (*Scenario, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open '%s': %v", filename, err)
+	}
+	defer fd.Close()
+	s, err := ReadBundle(fd)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", filename, err)
+	}
+	return s, nil
+}
+
+// SaveBundle saves the scenario to a file in the format read by ReadBundle.
+func (s *Scenario) SaveBundle(filename string) error {
+	return writeFile(filename, s.WriteBundle)
+}
+
+// writeFile creates a file and fills it using write.
+func writeFile(filename string, write func(io.Writer) error) error {
+	fd, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create '%s': %v", filename, err)
+	}
+	err = write(fd)
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write '%s': %v", filename, err)
+	}
+	return nil
+}
+
+// loadLines loads a text file and passes its lines to read.
+func loadLines(filename string, read func(lr *lineReader) error) error {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open '%s': %v", filename, err)
+	}
+	defer fd.Close()
+	if err = read(newLineReader(fd)); err != nil {
+		return fmt.Errorf("'%s': %w", filename, err)
+	}
+	return nil
+}
+
+// LoadLevelsDir loads the maps of a scenario's levels from a folder containing
+// 01.txt ... 20.txt in the format read by ReadASCII.
+func LoadLevelsDir(dir string) ([]*Map, error) {
+	levels := make([]*Map, N_LEVELS)
+	for n := 1; n <= N_LEVELS; n++ {
+		m, err := LoadASCII(filepath.Join(dir, fmt.Sprintf("%02d.txt", n)))
+		if err != nil {
+			return nil, err
+		}
+		levels[n-1] = m
+	}
+	return levels, nil
+}
+
+// LoadScenarioDir loads a scenario from a folder containing 01.txt ... 20.txt
+// in the format read by ReadASCII, plus Borders.csv, Transporters.csv and
+// Puzzle.csv. Borders.csv contains one line per level. Transporters.csv
+// starts with a "Transporters:" line, then has one line per transporter
+// (src level,x,y,dest level,x,y). Puzzle.csv starts with a "w,h" line, then
+// has one level,x,y line per piece. Each CSV ends at the first blank line.
+//
+// Transporters.csv and Puzzle.csv are loaded leniently so that Validate can
+// report everything that's wrong with them: lines which can't be parsed are
+// left out of Transporters and Pieces and recorded in LoadProblems, as are
+// surplus pieces in Puzzle.csv, which are otherwise ignored. Every
+// transporter line, and each piece line up to the puzzle's size, is kept in
+// TransporterText or PieceText, so a bundle written from the scenario has the
+// same lines and counts as mkscenario has always written.
+func LoadScenarioDir(dir string) (*Scenario, error) {
+	s := &Scenario{}
+	err := loadLines(filepath.Join(dir, "Borders.csv"),
+		func(lr *lineReader) error {
+			lines, err := lr.nonBlank()
+			if err != nil {
+				return err
+			}
+			if len(lines) < N_LEVELS {
+				return lr.errorf("found %d levels, expected %d",
+					len(lines), N_LEVELS)
+			}
+			for n := range s.Levels {
+				b, err := ParseBorder(lines[n])
+				if err != nil {
+					return &ParseError{n + 1, 0,
+						fmt.Sprintf("level %d: %v", n+1, err)}
+				}
+				s.Levels[n].Border = b
+				s.Levels[n].BorderText = lines[n]
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	levels, err := LoadLevelsDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for n, m := range levels {
+		s.Levels[n].Map = m
+	}
+	err = loadLines(filepath.Join(dir, "Transporters.csv"),
+		func(lr *lineReader) error {
+			if _, err := lr.next(); err != nil {
+				return err
+			}
+			lines, err := lr.nonBlank()
+			if err != nil {
+				return err
+			}
+			s.TransporterText = lines
+			for i, line := range lines {
+				// Line numbers start at 2 because of the heading
+				tp, err := parseTransporter(line, i+2)
+				if err != nil {
+					s.addLoadProblem("Transporters.csv", err)
+					continue
+				}
+				s.Transporters = append(s.Transporters, tp)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = loadLines(filepath.Join(dir, "Puzzle.csv"),
+		func(lr *lineReader) error {
+			line, err := lr.next()
+			if err != nil {
+				return err
+			}
+			// If the size can't be parsed, keep all the pieces
+			count := -1
+			if size, err := parseInts(line, 2, lr.lineNum); err != nil {
+				s.addLoadProblem("Puzzle.csv", err)
+			} else {
+				s.Puzzle.Width = size[0]
+				s.Puzzle.Height = size[1]
+				count = s.Puzzle.Width * s.Puzzle.Height
+			}
+			lines, err := lr.nonBlank()
+			if err != nil {
+				return err
+			}
+			if count >= 0 && len(lines) > count {
+				// The last line is often a duplicate
+				s.LoadProblems = append(s.LoadProblems, Problem{
+					Check: CHECK_PUZZLE_COUNT,
+					Message: fmt.Sprintf("Puzzle.csv has %d surplus "+
+						"pieces from line %d, which are ignored",
+						len(lines)-count, count+2),
+				})
+				lines = lines[:count]
+			}
+			s.Puzzle.PieceText = lines
+			for i, line := range lines {
+				pk, err := parsePiece(line, i+2)
+				if err != nil {
+					s.addLoadProblem("Puzzle.csv", err)
+					continue
+				}
+				s.Puzzle.Pieces = append(s.Puzzle.Pieces, pk)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// addLoadProblem records an error in a line of a CSV file which
+// LoadScenarioDir skipped.
+func (s *Scenario) addLoadProblem(filename string, err error) {
+	s.LoadProblems = append(s.LoadProblems, Problem{
+		Check:   CHECK_PARSE,
+		Message: fmt.Sprintf("%s %v", filename, err),
+	})
+}
+
+// SaveScenarioDir saves the scenario in the folder layout read by
+// LoadScenarioDir. The folder is created if necessary.
+func (s *Scenario) SaveScenarioDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create folder '%s': %v", dir, err)
+	}
+	for n := 1; n <= N_LEVELS; n++ {
+		err := s.Levels[n-1].SaveASCII(
+			filepath.Join(dir, fmt.Sprintf("%02d.txt", n)))
+		if err != nil {
+			return err
+		}
+	}
+	err := writeFile(filepath.Join(dir, "Borders.csv"),
+		func(w io.Writer) error {
+			for _, lvl := range s.Levels {
+				if _, err := fmt.Fprintln(w, lvl.BorderLine()); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(dir, "Transporters.csv"),
+		func(w io.Writer) error {
+			bw := bufio.NewWriter(w)
+			fmt.Fprintln(bw, "Transporters:")
+			for _, line := range s.TransporterLines() {
+				fmt.Fprintln(bw, line)
+			}
+			return bw.Flush()
+		})
+	if err != nil {
+		return err
+	}
+	return s.Puzzle.SaveCSV(filepath.Join(dir, "Puzzle.csv"))
+}
+
+// WriteCSV writes the puzzle in the Puzzle.csv format described for
+// LoadScenarioDir.
+func (p *Puzzle) WriteCSV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%d,%d\n", p.Width, p.Height)
+	for _, line := range p.PieceLines() {
+		fmt.Fprintln(bw, line)
+	}
+	return bw.Flush()
+}
+
+// SaveCSV saves the puzzle to a file in the format written by WriteCSV.
+func (p *Puzzle) SaveCSV(filename string) error {
+	return writeFile(filename, p.WriteCSV)
+}
+
+// FindPuzzlePieces returns the positions of all the puzzle pieces in levels,
+// where levels[n] is level n+1. They're in order of level, then row, then
+// column.
+func FindPuzzlePieces(levels []*Map) []PosKey {
+	var pieces []PosKey
+	for n, m := range levels {
+		for y := 0; y < m.Height; y++ {
+			for x := 0; x < m.Width; x++ {
+				if m.At(x, y) == T_PUZZLE {
+					pieces = append(pieces, NewPosKey(n+1, x, y))
+				}
+			}
+		}
+	}
+	return pieces
+}
@@ -0,0 +1,246 @@
+package repton2
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testBundle returns a small scenario in bundle format. border gives each
+// level's Borders.csv line.
+func testBundle(border func(n int) string) string {
+	var sb strings.Builder
+	for n := 1; n <= N_LEVELS; n++ {
+		fmt.Fprintf(&sb, "%02d\n%s\nblue\n3,2\n", n, border(n))
+		if n == 1 {
+			sb.WriteString("OU.\n.U1\n")
+		} else {
+			sb.WriteString("...\n999\n")
+		}
+		if n == N_LEVELS {
+			sb.WriteString("--\n")
+		} else {
+			sb.WriteString("-\n")
+		}
+	}
+	sb.WriteString("Transporters: 1\n1,0,0,2,0,0\n--\n")
+	sb.WriteString("Puzzle: 1,2\n1,1,0\n1,1,1\n--\n")
+	return sb.String()
+}
+
+func canonicalBorder(n int) string {
+	return fmt.Sprintf("%s,Viewable,32", SkyNames[n%3])
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	canonical := testBundle(canonicalBorder)
+	oddBorders := testBundle(func(n int) string {
+		return fmt.Sprintf("%s, No ,%d", strings.ToLower(SkyNames[n%3]), 32)
+	})
+	oddLines := strings.Replace(strings.Replace(canonical,
+		"\n1,0,0,2,0,0\n", "\n1, 0,0, 2,0,0\n", 1),
+		"\n1,1,1\n", "\n01,1 ,1\n", 1)
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"canonical", canonical, canonical},
+		{"CRLF", strings.ReplaceAll(canonical, "\n", "\r\n"), canonical},
+		{"non-canonical borders", oddBorders, oddBorders},
+		{"non-canonical transporters and pieces", oddLines, oddLines},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := ReadBundle(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := s.WriteBundle(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("wrote:\n%s\nexpected:\n%s", buf.String(),
+					test.expected)
+			}
+		})
+	}
+}
+
+func TestReadBundleFields(t *testing.T) {
+	s, err := ReadBundle(strings.NewReader(testBundle(func(n int) string {
+		return " meteors,VISITED, 32"
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lvl := &s.Levels[0]
+	if lvl.Border != (Border{SKY_METEORS, MAP_VISITED, T_BRICK_GROUND}) {
+		t.Errorf("border is %v", lvl.Border)
+	}
+	if lvl.Theme != "Blue" || lvl.Width != 3 || lvl.Height != 2 ||
+		lvl.At(0, 0) != T_TRANSPORTER || lvl.At(1, 1) != T_PUZZLE {
+		t.Errorf("level 1 is %s %d x %d: %v", lvl.Theme, lvl.Width,
+			lvl.Height, lvl.Tiles)
+	}
+	tp := Transporter{NewPosKey(1, 0, 0), NewPosKey(2, 0, 0)}
+	if len(s.Transporters) != 1 || s.Transporters[0] != tp {
+		t.Errorf("transporters are %v", s.Transporters)
+	}
+	if s.Puzzle.Width != 1 || s.Puzzle.Height != 2 ||
+		len(s.Puzzle.Pieces) != 2 || s.Puzzle.Pieces[1] != NewPosKey(1, 1, 1) {
+		t.Errorf("puzzle is %+v", s.Puzzle)
+	}
+}
+
+func TestReadBundleErrors(t *testing.T) {
+	good := testBundle(canonicalBorder)
+	tests := []struct {
+		name, old, new string
+		line           int
+	}{
+		{"bad level number", "02\n", "03\n", 8},
+		{"bad border", "Surface,Viewable,32", "Surface,Viewable,99", 2},
+		{"bad theme", "blue", "purple", 3},
+		{"ragged row", "OU.", "OU", 5},
+		{"bad transporter", "1,0,0,2,0,0", "1,0,0,2,0", 142},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := strings.Replace(good, test.old, test.new, 1)
+			_, err := ReadBundle(strings.NewReader(input))
+			pe, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if pe.Line != test.line {
+				t.Errorf("error at line %d, expected %d: %v",
+					pe.Line, test.line, err)
+			}
+		})
+	}
+}
+
+func TestScenarioDirKeepsBorders(t *testing.T) {
+	input := testBundle(func(n int) string { return "surface, No ,32" })
+	s, err := ReadBundle(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.SaveScenarioDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err = LoadScenarioDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.WriteBundle(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != input {
+		t.Errorf("wrote:\n%s\nexpected:\n%s", buf.String(), input)
+	}
+}
+
+func TestScenarioDirKeepsCSVLines(t *testing.T) {
+	s, err := ReadBundle(strings.NewReader(testBundle(canonicalBorder)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.SaveScenarioDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Lines are written as they were, including ones which can't be parsed,
+	// and surplus pieces are dropped, as mkscenario has always done
+	files := map[string]string{
+		"Transporters.csv": "Transporters:\n1, 0,0,2,0,0\n1,0,0,2,0\n",
+		"Puzzle.csv":       "1,2\n1,1,0\n1,x,1\n1,1,1\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = LoadScenarioDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.WriteBundle(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "--\nTransporters: 2\n1, 0,0,2,0,0\n1,0,0,2,0\n--\n" +
+		"Puzzle: 1,2\n1,1,0\n1,x,1\n--\n"
+	if !strings.HasSuffix(buf.String(), expected) {
+		t.Errorf("wrote:\n%s\nexpected it to end with:\n%s", buf.String(),
+			expected)
+	}
+}
+
+func TestLoadScenarioDirLenient(t *testing.T) {
+	s, err := ReadBundle(strings.NewReader(testBundle(canonicalBorder)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		transporters string
+		puzzle       string
+		checks       []string
+	}{
+		{"valid", "Transporters:\n1,0,0,2,0,0\n", "1,2\n1,1,0\n1,1,1\n", nil},
+		{"missing piece", "Transporters:\n1,0,0,2,0,0\n", "1,2\n1,1,0\n",
+			[]string{CHECK_PUZZLE_POS, CHECK_PUZZLE_COUNT}},
+		{"surplus piece", "Transporters:\n1,0,0,2,0,0\n",
+			"1,2\n1,1,0\n1,1,1\n1,1,1\n", []string{CHECK_PUZZLE_COUNT}},
+		{"bad piece", "Transporters:\n1,0,0,2,0,0\n", "1,2\n1,1,0\n1,x,1\n",
+			[]string{CHECK_PARSE, CHECK_PUZZLE_POS, CHECK_PUZZLE_COUNT}},
+		{"bad transporter", "Transporters:\n1,0,0,2,0\n", "1,2\n1,1,0\n1,1,1\n",
+			[]string{CHECK_PARSE, CHECK_TRANSPORTER_SRC}},
+		{"piece outside level", "Transporters:\n1,0,0,2,0,0\n",
+			"1,2\n1,1,0\n1,5,1\n",
+			[]string{CHECK_LEVEL_SIZE, CHECK_PUZZLE_POS}},
+		{"dest outside level", "Transporters:\n1,0,0,2,0,2\n",
+			"1,2\n1,1,0\n1,1,1\n", []string{CHECK_LEVEL_SIZE}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := s.SaveScenarioDir(dir); err != nil {
+				t.Fatal(err)
+			}
+			files := map[string]string{
+				"Transporters.csv": test.transporters,
+				"Puzzle.csv":       test.puzzle,
+			}
+			for name, content := range files {
+				err := os.WriteFile(filepath.Join(dir, name),
+					[]byte(content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			loaded, err := LoadScenarioDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var checks []string
+			for _, p := range loaded.Validate() {
+				checks = append(checks, p.Check)
+			}
+			if !reflect.DeepEqual(checks, test.checks) {
+				t.Errorf("checks failed: %v, expected %v", checks,
+					test.checks)
+			}
+		})
+	}
+}
@@ -1,5 +1,11 @@
 package repton2
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // All the tiles
 const (
 	T_BLANK = iota
@@ -39,3 +45,204 @@ const (
 
 	N_TILES
 )
+
+// T_UNKNOWN is used for tiles which couldn't be recognised. It has no
+// TileInfo.
+const (
+	T_UNKNOWN    = -1
+	UNKNOWN_CHAR = '?'
+	UNKNOWN_NAME = "UNKNOWN"
+)
+
+// Tile properties, which may be combined
+const (
+	P_SOLID       = 1 << iota // Repton can't walk through it
+	P_FALLS                   // Falls if there's nothing underneath it
+	P_PUSHABLE                // Repton can push it sideways
+	P_DEADLY                  // Kills Repton on contact
+	P_COLLECTIBLE             // Repton picks it up by walking into it
+)
+
+// Edge types, for the brick and wall tiles which have different sprites for
+// their edges and corners
+const (
+	E_NONE = iota
+	E_TL
+	E_TR
+	E_L
+	E_R
+	E_T
+	E_B
+	E_BL
+	E_BR
+)
+
+// RMD_NONE is the RMDCode of a tile which has no code of its own in Repton
+// Map Decoder's CSV format. It is written as "unk".
+const RMD_NONE = -1
+
+// TileInfo holds the metadata for one tile type.
+type TileInfo struct {
+	Type    int    // The T_ constant
+	Name    string // The T_ constant's name without the T_ prefix
+	Char    byte   // Character used in the ASCII map format
+	RMDCode int    // Code used in Repton Map Decoder's CSV format
+	Props   int    // P_ flags
+	Edge    int    // E_ constant
+}
+
+// TileInfos holds metadata for every tile type, indexed by the T_ constants.
+var TileInfos = [N_TILES]TileInfo{
+	{T_BLANK, "BLANK", '.', 0, 0, E_NONE},
+	{T_DIAMOND, "DIAMOND", '1', 1, P_FALLS | P_COLLECTIBLE, E_NONE},
+	{T_ROCK, "ROCK", '2', 2, P_SOLID | P_FALLS | P_PUSHABLE, E_NONE},
+	{T_EGG, "EGG", '3', 33, P_SOLID | P_FALLS | P_PUSHABLE, E_NONE},
+	{T_SAFE, "SAFE", '4', 4, P_SOLID, E_NONE},
+	{T_KEY, "KEY", '5', 34, P_COLLECTIBLE, E_NONE},
+	{T_SPIRIT, "SPIRIT", '6', 6, P_DEADLY, E_NONE},
+	{T_CAGE, "CAGE", '7', 7, P_SOLID, E_NONE},
+	{T_FLOWER, "FLOWER", '8', 8, P_SOLID, E_NONE},
+	{T_BRICK_MID, "BRICK_MID", '9', 9, P_SOLID, E_NONE},
+	{T_BRICK_TL, "BRICK_TL", 'A', 10, P_SOLID, E_TL},
+	{T_BRICK_TR, "BRICK_TR", 'B', 11, P_SOLID, E_TR},
+	{T_BRICK_L, "BRICK_L", 'C', 12, P_SOLID, E_L},
+	{T_BRICK_R, "BRICK_R", 'D', 13, P_SOLID, E_R},
+	{T_BRICK_T, "BRICK_T", 'E', 14, P_SOLID, E_T},
+	{T_BRICK_B, "BRICK_B", 'F', 15, P_SOLID, E_B},
+	{T_BRICK_BL, "BRICK_BL", 'G', 16, P_SOLID, E_BL},
+	{T_BRICK_BR, "BRICK_BR", 'H', 17, P_SOLID, E_BR},
+	{T_DIRT_1, "DIRT_1", 'I', 18, 0, E_NONE},
+	{T_DIRT_2, "DIRT_2", 'J', 19, 0, E_NONE},
+	{T_DIRT_3, "DIRT_3", 'K', 20, 0, E_NONE},
+	{T_WALL_MID, "WALL_MID", 'L', 21, P_SOLID, E_NONE},
+	{T_WALL_TL, "WALL_TL", 'M', 22, P_SOLID, E_TL},
+	{T_WALL_TR, "WALL_TR", 'N', 23, P_SOLID, E_TR},
+	{T_TRANSPORTER, "TRANSPORTER", 'O', 24, 0, E_NONE},
+	{T_REPTON, "REPTON", 'P', 25, 0, E_NONE},
+	{T_END, "END", 'Q', 26, 0, E_NONE},
+	{T_SKULL, "SKULL", 'R', 27, P_SOLID | P_DEADLY, E_NONE},
+	{T_WALL_BL, "WALL_BL", 'S', 28, P_SOLID, E_BL},
+	{T_WALL_BR, "WALL_BR", 'T', 29, P_SOLID, E_BR},
+	{T_PUZZLE, "PUZZLE", 'U', RMD_NONE, P_COLLECTIBLE, E_NONE},
+	{T_SAVE, "SAVE", 'V', 30, 0, E_NONE},
+	{T_BRICK_GROUND, "BRICK_GROUND", 'W', 32, P_SOLID, E_NONE},
+	{T_SKULL_RED, "SKULL_RED", 'X', 31, P_SOLID | P_DEADLY, E_NONE},
+}
+
+// rmdAliases maps other codes which Repton Map Decoder CSV files may contain
+// to tiles. 3 and 5 are the egg's and key's T_ constants, which csv2asc has
+// always accepted, although the tiles are written as 33 and 34.
+var rmdAliases = map[int]int{
+	3: T_EGG,
+	5: T_KEY,
+}
+
+var (
+	tilesByName = make(map[string]int)
+	tilesByChar = make(map[byte]int)
+	tilesByRMD  = make(map[int]int)
+)
+
+func init() {
+	for t, info := range TileInfos {
+		tilesByName[info.Name] = t
+		tilesByChar[info.Char] = t
+		if info.RMDCode != RMD_NONE {
+			tilesByRMD[info.RMDCode] = t
+		}
+	}
+	for code, t := range rmdAliases {
+		tilesByRMD[code] = t
+	}
+}
+
+// Has returns true if the tile has all the given P_ flags.
+func (info *TileInfo) Has(props int) bool {
+	return info.Props&props == props
+}
+
+// TileByName looks up a tile by its name. The name is case-insensitive and
+// may optionally include the T_ prefix.
+func TileByName(name string) (t int, ok bool) {
+	name = strings.ToUpper(name)
+	t, ok = tilesByName[strings.TrimPrefix(name, "T_")]
+	if !ok {
+		t = -1
+	}
+	return
+}
+
+// TileByChar looks up a tile by its ASCII map character. UNKNOWN_CHAR gives
+// T_UNKNOWN.
+func TileByChar(c byte) (t int, ok bool) {
+	if c == UNKNOWN_CHAR {
+		return T_UNKNOWN, true
+	}
+	t, ok = tilesByChar[c]
+	if !ok {
+		t = -1
+	}
+	return
+}
+
+// TileByRMDCode looks up a tile by its Repton Map Decoder code, including
+// the aliases in rmdAliases.
+func TileByRMDCode(code int) (t int, ok bool) {
+	t, ok = tilesByRMD[code]
+	if !ok {
+		t = -1
+	}
+	return
+}
+
+// TileChar returns the ASCII character representing tile type t.
+func TileChar(t int) byte {
+	if t == T_UNKNOWN {
+		return UNKNOWN_CHAR
+	}
+	return TileInfos[t].Char
+}
+
+// TileName returns the name of tile type t.
+func TileName(t int) string {
+	if t == T_UNKNOWN {
+		return UNKNOWN_NAME
+	}
+	return TileInfos[t].Name
+}
+
+// CharTile returns the tile type represented by an ASCII character. ok is
+// false if c doesn't represent a tile.
+func CharTile(c byte) (t int, ok bool) {
+	return TileByChar(c)
+}
+
+// TileRMDString returns the Repton Map Decoder CSV field for tile type t.
+// Puzzle pieces and unknown tiles are both "unk".
+func TileRMDString(t int) string {
+	if t == T_UNKNOWN {
+		return "unk"
+	}
+	code := TileInfos[t].RMDCode
+	if code == RMD_NONE {
+		return "unk"
+	}
+	return strconv.Itoa(code)
+}
+
+// ParseRMDString converts a Repton Map Decoder CSV field to a tile type.
+// "unk" is treated as a puzzle piece.
+func ParseRMDString(s string) (int, error) {
+	if s == "unk" {
+		return T_PUZZLE, nil
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return -1, fmt.Errorf("can't parse '%s' as number", s)
+	}
+	t, ok := TileByRMDCode(code)
+	if !ok {
+		return -1, fmt.Errorf("unknown tile code %d", code)
+	}
+	return t, nil
+}
@@ -0,0 +1,42 @@
+package repton2
+
+import "testing"
+
+func TestParseRMDString(t *testing.T) {
+	tests := []struct {
+		s    string
+		tile int
+	}{
+		{"0", T_BLANK},
+		{"1", T_DIAMOND},
+		{"3", T_EGG},
+		{"5", T_KEY},
+		{"30", T_SAVE},
+		{"31", T_SKULL_RED},
+		{"32", T_BRICK_GROUND},
+		{"33", T_EGG},
+		{"34", T_KEY},
+		{"unk", T_PUZZLE},
+	}
+	for _, test := range tests {
+		tile, err := ParseRMDString(test.s)
+		if err != nil {
+			t.Errorf("'%s': %v", test.s, err)
+		} else if tile != test.tile {
+			t.Errorf("'%s' is %s, expected %s", test.s,
+				TileName(tile), TileName(test.tile))
+		}
+	}
+	for _, s := range []string{"35", "-1", "x"} {
+		if _, err := ParseRMDString(s); err == nil {
+			t.Errorf("'%s' was accepted", s)
+		}
+	}
+	// The aliases mustn't change what's written
+	if s := TileRMDString(T_EGG); s != "33" {
+		t.Errorf("EGG is written as '%s', expected '33'", s)
+	}
+	if s := TileRMDString(T_KEY); s != "34" {
+		t.Errorf("KEY is written as '%s', expected '34'", s)
+	}
+}
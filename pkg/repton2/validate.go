@@ -0,0 +1,170 @@
+package repton2
+
+import "fmt"
+
+// Problem describes an inconsistency found by Scenario.Validate. Level, X and
+// Y give the position concerned, if any; Level is 0 if the problem isn't
+// specific to a level.
+type Problem struct {
+	Check   string `json:"check"`
+	Level   int    `json:"level,omitempty"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Level == 0 {
+		return fmt.Sprintf("%s: %s", p.Check, p.Message)
+	}
+	return fmt.Sprintf("%s at %d,%d,%d: %s",
+		p.Check, p.Level, p.X, p.Y, p.Message)
+}
+
+// Names of the checks performed by Validate. CHECK_LEVEL_SIZE checks that
+// each level is present with a valid size, and that the positions in
+// Transporters.csv and Puzzle.csv are within the size of their levels.
+// Borders.csv has no positions to check.
+const (
+	CHECK_LEVEL_SIZE      = "level-size"
+	CHECK_TRANSPORTER_SRC = "transporter-src"
+	CHECK_TRANSPORTER_DST = "transporter-dest"
+	CHECK_PUZZLE_POS      = "puzzle-position"
+	CHECK_PUZZLE_COUNT    = "puzzle-count"
+	CHECK_UNKNOWN_TILE    = "unknown-tile"
+	CHECK_PARSE           = "parse"
+)
+
+// Unchecked lists what Validate deliberately doesn't check, so that reports
+// can say so. Levels aren't compared with each other because Repton 2 levels
+// may differ in size.
+var Unchecked = []string{
+	"consistent level sizes: Repton 2 levels may differ in size",
+}
+
+// tileAt returns the tile at pk, or -1 if pk is outside the scenario.
+func (s *Scenario) tileAt(pk PosKey) int {
+	l, x, y := pk.Decode()
+	if l < 1 || l > N_LEVELS {
+		return -1
+	}
+	m := s.Levels[l-1].Map
+	if m == nil || x >= m.Width || y >= m.Height {
+		return -1
+	}
+	return m.At(x, y)
+}
+
+// outside returns a description of why pk isn't a position in the scenario,
+// or "" if it is.
+func (s *Scenario) outside(pk PosKey) string {
+	l, x, y := pk.Decode()
+	if l < 1 || l > N_LEVELS {
+		return fmt.Sprintf("there is no level %d", l)
+	}
+	m := s.Levels[l-1].Map
+	if x >= m.Width || y >= m.Height {
+		return fmt.Sprintf("position %d,%d is outside the %d x %d level",
+			x, y, m.Width, m.Height)
+	}
+	return ""
+}
+
+// Validate checks that the levels, transporters and puzzle are consistent
+// with each other, returning a list of the problems found, if any, after
+// LoadProblems.
+func (s *Scenario) Validate() []Problem {
+	problems := append([]Problem(nil), s.LoadProblems...)
+	report := func(check string, pk PosKey, format string, args ...any) {
+		l, x, y := pk.Decode()
+		problems = append(problems,
+			Problem{check, l, x, y, fmt.Sprintf(format, args...)})
+	}
+
+	nLoadProblems := len(problems)
+	for n, lvl := range s.Levels {
+		pk := NewPosKey(n+1, 0, 0)
+		if lvl.Map == nil {
+			report(CHECK_LEVEL_SIZE, pk, "level is missing")
+		} else if lvl.Width < 1 || lvl.Height < 1 ||
+			lvl.Width > 256 || lvl.Height > 256 {
+			report(CHECK_LEVEL_SIZE, pk, "invalid size %d x %d",
+				lvl.Width, lvl.Height)
+		}
+	}
+	if len(problems) != nLoadProblems {
+		// Other checks would be unreliable
+		return problems
+	}
+
+	transporters := make(map[PosKey]bool)
+	for _, tp := range s.Transporters {
+		if transporters[tp.Src] {
+			report(CHECK_TRANSPORTER_SRC, tp.Src,
+				"transporter listed more than once")
+		}
+		transporters[tp.Src] = true
+		if msg := s.outside(tp.Src); msg != "" {
+			report(CHECK_LEVEL_SIZE, tp.Src, "Transporters.csv src: %s", msg)
+		} else if t := s.tileAt(tp.Src); t != T_TRANSPORTER {
+			report(CHECK_TRANSPORTER_SRC, tp.Src,
+				"Transporters.csv contains src, but tile is not a transporter")
+		}
+		if msg := s.outside(tp.Dest); msg != "" {
+			report(CHECK_LEVEL_SIZE, tp.Dest, "Transporters.csv dest: %s", msg)
+		} else if t := s.tileAt(tp.Dest); t != T_BLANK {
+			report(CHECK_TRANSPORTER_DST, tp.Dest,
+				"Transporters.csv contains dest, but tile is not a blank")
+		}
+	}
+	pieces := make(map[PosKey]bool)
+	for _, pk := range s.Puzzle.Pieces {
+		if pieces[pk] {
+			report(CHECK_PUZZLE_POS, pk, "puzzle piece listed more than once")
+		}
+		pieces[pk] = true
+		if msg := s.outside(pk); msg != "" {
+			report(CHECK_LEVEL_SIZE, pk, "Puzzle.csv: %s", msg)
+		} else if t := s.tileAt(pk); t != T_PUZZLE {
+			report(CHECK_PUZZLE_POS, pk,
+				"Puzzle.csv contains position, but tile is not a puzzle piece")
+		}
+	}
+
+	nPuzzles := 0
+	for n, lvl := range s.Levels {
+		for y := 0; y < lvl.Height; y++ {
+			for x := 0; x < lvl.Width; x++ {
+				pk := NewPosKey(n+1, x, y)
+				switch lvl.At(x, y) {
+				case T_TRANSPORTER:
+					if !transporters[pk] {
+						report(CHECK_TRANSPORTER_SRC, pk,
+							"transporter not found in Transporters.csv")
+					}
+				case T_PUZZLE:
+					nPuzzles++
+					if !pieces[pk] {
+						report(CHECK_PUZZLE_POS, pk,
+							"puzzle piece not found in Puzzle.csv")
+					}
+				case T_UNKNOWN:
+					report(CHECK_UNKNOWN_TILE, pk, "tile is unrecognised")
+				}
+			}
+		}
+	}
+
+	count := s.Puzzle.Width * s.Puzzle.Height
+	if len(s.Puzzle.Pieces) != count {
+		report(CHECK_PUZZLE_COUNT, 0,
+			"Puzzle.csv lists %d pieces, but its size is %d x %d = %d",
+			len(s.Puzzle.Pieces), s.Puzzle.Width, s.Puzzle.Height, count)
+	}
+	if nPuzzles != count {
+		report(CHECK_PUZZLE_COUNT, 0,
+			"levels contain %d puzzle pieces, but puzzle size is %d x %d = %d",
+			nPuzzles, s.Puzzle.Width, s.Puzzle.Height, count)
+	}
+	return problems
+}
@@ -0,0 +1,252 @@
+// sprites loads and saves sets of reference sprites for the tiles in each of
+// Repton 2's colour themes
+package sprites
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/realh/repmap/pkg/atlas"
+	"github.com/realh/repmap/pkg/repton"
+	"github.com/realh/repmap/pkg/repton2"
+)
+
+// COMMON is the name of the folder holding sprites which are the same in
+// every theme
+const COMMON = "common"
+
+// ORDER_FILE is the name of the file in a folder of numbered sprites which
+// says which tile each one is; see loadOrder.
+const ORDER_FILE = "order.txt"
+
+// Set holds a sprite for each tile type, indexed by the T_ constants, for
+// each colour theme, keyed by the theme's name. Missing sprites are nil.
+type Set map[string][]image.Image
+
+// Get returns the sprite for tile t in theme, or nil.
+func (s Set) Get(theme string, t int) image.Image {
+	sprites := s[theme]
+	if sprites == nil || t < 0 || t >= len(sprites) {
+		return nil
+	}
+	return sprites[t]
+}
+
+// Missing returns the tile types which don't have a sprite in theme.
+func (s Set) Missing(theme string) []int {
+	var missing []int
+	for t := 0; t < repton2.N_TILES; t++ {
+		if s.Get(theme, t) == nil {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
+
+// loadIfExists loads a PNG, returning nil without an error if it doesn't
+// exist.
+func loadIfExists(filename string) (image.Image, error) {
+	img, err := repton.LoadImage(filename)
+	if err != nil {
+		if _, statErr := os.Stat(filename); errors.Is(statErr, fs.ErrNotExist) {
+			return nil, nil
+		}
+	}
+	return img, err
+}
+
+// loadOrder loads a list of tile names, one per line, saying which tile each
+// sprite in an atlas, or each numbered sprite (0.png, 1.png ...) in a folder
+// is. This allows the unordered output of extractatlases to be used. A name
+// of "-" means the sprite isn't used. Blank lines and lines starting with '#'
+// are ignored. If filename doesn't exist the result is nil.
+func loadOrder(filename string) ([]int, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var order []int
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t := -1
+		if line != "-" {
+			var ok bool
+			if t, ok = repton2.TileByName(line); !ok {
+				return nil, fmt.Errorf("%s line %d: unknown tile '%s'",
+					filename, n+1, line)
+			}
+		}
+		order = append(order, t)
+	}
+	return order, nil
+}
+
+// loadFolder loads sprites named after the tiles, eg DIAMOND.png or
+// T_DIAMOND.png, from dir, and numbered sprites listed in its ORDER_FILE.
+// Tiles which already have a sprite in sprites are skipped.
+func loadFolder(dir string, sprites []image.Image) error {
+	order, err := loadOrder(filepath.Join(dir, ORDER_FILE))
+	if err != nil {
+		return err
+	}
+	for i, t := range order {
+		if t == -1 || sprites[t] != nil {
+			continue
+		}
+		img, err := loadIfExists(filepath.Join(dir, fmt.Sprintf("%d.png", i)))
+		if err != nil {
+			return err
+		}
+		sprites[t] = img
+	}
+	for t, info := range repton2.TileInfos {
+		if sprites[t] != nil {
+			continue
+		}
+		for _, name := range []string{info.Name, "T_" + info.Name} {
+			img, err := loadIfExists(filepath.Join(dir, name+".png"))
+			if err != nil {
+				return err
+			}
+			if img != nil {
+				sprites[t] = img
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// SplitAtlas splits an atlas into its sprites. The atlas must have been
+// composed by atlas.ComposeAtlas from sprites in the order of the T_
+// constants.
+func SplitAtlas(img image.Image) []image.Image {
+	order := make([]int, repton2.N_TILES)
+	for t := range order {
+		order[t] = t
+	}
+	return SplitOrderedAtlas(img, order)
+}
+
+// SplitOrderedAtlas is like SplitAtlas for an atlas composed from sprites in
+// any order. order gives the tile type of each sprite in the atlas, or -1 to
+// skip it. The result is indexed by tile type.
+func SplitOrderedAtlas(img image.Image, order []int) []image.Image {
+	columns, rows := atlas.BestFit(len(order))
+	b := img.Bounds()
+	tw := b.Dx() / columns
+	th := b.Dy() / rows
+	sprites := make([]image.Image, repton2.N_TILES)
+	for i, t := range order {
+		if t == -1 {
+			continue
+		}
+		x0 := b.Min.X + (i%columns)*tw
+		y0 := b.Min.Y + (i/columns)*th
+		r := image.Rect(x0, y0, x0+tw, y0+th)
+		sprites[t] = repton.SubImage(img, &r)
+	}
+	return sprites
+}
+
+// loadAtlas loads and splits name.png from dir, if it exists. If name.txt
+// exists it gives the order of the sprites (see loadOrder), otherwise they
+// must be in the order of the T_ constants unless requireOrder is true, in
+// which case the atlas is ignored. Sprites are only copied to tiles in
+// sprites which don't already have one. The result is true if the atlas was
+// loaded.
+func loadAtlas(dir, name string, sprites []image.Image, requireOrder bool,
+) (bool, error) {
+	order, err := loadOrder(filepath.Join(dir, name+".txt"))
+	if err != nil || (order == nil && requireOrder) {
+		return false, err
+	}
+	img, err := loadIfExists(filepath.Join(dir, name+".png"))
+	if img == nil || err != nil {
+		return false, err
+	}
+	var split []image.Image
+	if order != nil {
+		split = SplitOrderedAtlas(img, order)
+	} else {
+		split = SplitAtlas(img)
+	}
+	for t, sprt := range split {
+		if sprites[t] == nil {
+			sprites[t] = sprt
+		}
+	}
+	return true, nil
+}
+
+// LoadDir loads a sprite set from dir. For each theme, dir may contain either
+// an atlas called eg Blue.png (see SplitAtlas), or a folder called eg Blue
+// containing a PNG for each tile named after it, eg DIAMOND.png. Tiles which
+// are the same in every theme may be put in a folder called common instead.
+// Sprites in an atlas or folder may instead be in any order if their order is
+// given by a list of tile names, in eg Blue.txt for an atlas or
+// Blue/order.txt for numbered sprites in a folder (see loadOrder). This also
+// allows an atlas called common.png, which must have a common.txt.
+func LoadDir(dir string) (Set, error) {
+	set := make(Set)
+	for _, theme := range repton.ColourNames[:repton.KC_BLACK] {
+		sprites := make([]image.Image, repton2.N_TILES)
+		ok, err := loadAtlas(dir, theme, sprites, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if err = loadFolder(filepath.Join(dir, theme), sprites); err != nil {
+				return nil, err
+			}
+		}
+		if err = loadFolder(filepath.Join(dir, COMMON), sprites); err != nil {
+			return nil, err
+		}
+		if _, err = loadAtlas(dir, COMMON, sprites, true); err != nil {
+			return nil, err
+		}
+		for _, sprt := range sprites {
+			if sprt != nil {
+				set[theme] = sprites
+				break
+			}
+		}
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("no sprites found in '%s'", dir)
+	}
+	return set, nil
+}
+
+// SaveDir saves the set in dir in the folder layout read by LoadDir, with one
+// folder per theme.
+func (s Set) SaveDir(dir string) error {
+	for theme, sprites := range s {
+		themeDir := filepath.Join(dir, theme)
+		if err := os.MkdirAll(themeDir, 0755); err != nil {
+			return fmt.Errorf("unable to create folder '%s': %v", themeDir, err)
+		}
+		for t, sprt := range sprites {
+			if sprt == nil {
+				continue
+			}
+			err := repton.SavePNG(sprt, filepath.Join(themeDir,
+				repton2.TileInfos[t].Name+".png"))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}